@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	color "github.com/fatih/color"
 	registry "github.com/miguelmota/ipdr/registry"
@@ -23,6 +25,8 @@ var (
 	ErrOnlyOneArgumentRequired = errors.New("only one argument is required")
 	// ErrInvalidConvertFormat is error for when convert format is invalid
 	ErrInvalidConvertFormat = errors.New("convert format must be either \"docker\" or \"ipfs\"")
+	// ErrInvalidManifestFormat is error for when manifest format is invalid
+	ErrInvalidManifestFormat = errors.New("manifest format must be either \"docker\" or \"oci\"")
 )
 
 func main() {
@@ -33,6 +37,7 @@ func main() {
 	var ipfsHost string
 	var ipfsGateway string
 	var format string
+	var manifestFormat string
 	var dockerRegistryHost string
 	var port uint
 	var tlsCertPath string
@@ -40,7 +45,32 @@ func main() {
 	var silent bool
 	var cidResolvers []string
 	var cidStorePath string
+	var resolverTTL time.Duration
+	var resolverNegativeTTL time.Duration
+	var resolverToken string
+	var resolverPrecedence string
+	var resolverAuthority []string
+	var trustlessGateway bool
+	var gatewayTimeout time.Duration
+	var gatewayRace int
+	var contentSource string
+	var blobIndexPath string
+	var uploadDir string
+	var uploadTTL time.Duration
+	var disableDelete bool
+	var unpinOnDelete bool
+	var authHtpasswd string
+	var authKeyPath string
+	var authRealm string
+	var authService string
+	var authPolicy string
+	var upstream string
+	var upstreamTTL time.Duration
+	var cacheDir string
+	var cacheSize int64
 	var shortFormat bool
+	var username string
+	var password string
 
 	rootCmd := &cobra.Command{
 		Use:   "ipdr",
@@ -63,6 +93,9 @@ More info: https://github.com/miguelmota/ipdr`,
 			if len(args) != 1 {
 				return ErrOnlyOneArgumentRequired
 			}
+			if !(manifestFormat == registry.ManifestFormatDocker || manifestFormat == registry.ManifestFormatOCI) {
+				return ErrInvalidManifestFormat
+			}
 
 			return nil
 		},
@@ -71,6 +104,9 @@ More info: https://github.com/miguelmota/ipdr`,
 				DockerLocalRegistryHost: dockerRegistryHost,
 				IPFSHost:                ipfsHost,
 				IPFSGateway:             ipfsGateway,
+				ManifestFormat:          manifestFormat,
+				Username:                username,
+				Password:                password,
 				Debug:                   !silent,
 			})
 
@@ -93,6 +129,9 @@ More info: https://github.com/miguelmota/ipdr`,
 	pushCmd.Flags().BoolVarP(&silent, "silent", "s", false, "Silent flag suppresses logs and outputs only IPFS hash")
 	pushCmd.Flags().StringVarP(&ipfsHost, "ipfs-host", "", "127.0.0.1:5001", "A remote IPFS API host to push the image to. Eg. 127.0.0.1:5001")
 	pushCmd.Flags().StringVarP(&dockerRegistryHost, "docker-registry-host", "", "docker.local:5000", "The Docker local registry host. Eg. 127.0.0.1:5000 Eg. docker.local:5000")
+	pushCmd.Flags().StringVar(&manifestFormat, "manifest-format", registry.ManifestFormatDocker, "Image manifest format which can be \"docker\" or \"oci\"")
+	pushCmd.Flags().StringVar(&username, "username", os.Getenv("IPDR_USERNAME"), "Username to log in to the Docker local registry with, when it requires a login. Defaults to $IPDR_USERNAME")
+	pushCmd.Flags().StringVar(&password, "password", os.Getenv("IPDR_PASSWORD"), "Password to log in to the Docker local registry with. Defaults to $IPDR_PASSWORD")
 
 	pullCmd := &cobra.Command{
 		Use:   "pull",
@@ -113,6 +152,8 @@ More info: https://github.com/miguelmota/ipdr`,
 				DockerLocalRegistryHost: dockerRegistryHost,
 				IPFSHost:                ipfsHost,
 				IPFSGateway:             ipfsGateway,
+				Username:                username,
+				Password:                password,
 				Debug:                   !silent,
 			})
 
@@ -135,6 +176,8 @@ More info: https://github.com/miguelmota/ipdr`,
 	pullCmd.Flags().StringVarP(&ipfsHost, "ipfs-host", "", "127.0.0.1:5001", "A remote IPFS API host to pull the image from. Eg. 127.0.0.1:5001")
 	pullCmd.Flags().StringVarP(&ipfsGateway, "ipfs-gateway", "g", "127.0.0.1:8080", "The readonly IPFS Gateway URL to pull the image from. Eg. https://ipfs.io")
 	pullCmd.Flags().StringVarP(&dockerRegistryHost, "docker-registry-host", "", "docker.local:5000", "The Docker local registry host. Eg. 127.0.0.1:5000 Eg. docker.local:5000")
+	pullCmd.Flags().StringVar(&username, "username", os.Getenv("IPDR_USERNAME"), "Username to log in to the Docker local registry with, when it requires a login. Defaults to $IPDR_USERNAME")
+	pullCmd.Flags().StringVar(&password, "password", os.Getenv("IPDR_PASSWORD"), "Password to log in to the Docker local registry with. Defaults to $IPDR_PASSWORD")
 
 	serverCmd := &cobra.Command{
 		Use:   "server",
@@ -144,16 +187,53 @@ More info: https://github.com/miguelmota/ipdr`,
 			if err := ensureCIDStorePath(cidStorePath); err != nil {
 				return err
 			}
+			if resolverPrecedence != "first" && resolverPrecedence != "agree" {
+				return fmt.Errorf("invalid resolver precedence %q, expected first or agree", resolverPrecedence)
+			}
+			if contentSource != "gateway" && contentSource != "api" {
+				return fmt.Errorf("invalid content source %q, expected gateway or api", contentSource)
+			}
+			authority := make(map[string]string)
+			for _, a := range resolverAuthority {
+				sa := strings.SplitN(a, "=", 2)
+				if len(sa) != 2 || sa[0] == "" || sa[1] == "" {
+					return fmt.Errorf("invalid resolver authority %q, expected <repo glob>=<cid resolver>", a)
+				}
+				authority[sa[0]] = sa[1]
+			}
 
 			srv := server.NewServer(&server.Config{
-				Port:         port,
-				Debug:        !silent,
-				IPFSHost:     ipfsHost,
-				IPFSGateway:  ipfsGateway,
-				CIDResolvers: cidResolvers,
-				CIDStorePath: cidStorePath,
-				TLSKeyPath:   tlsKeyPath,
-				TLSCertPath:  tlsCertPath,
+				Port:                port,
+				Debug:               !silent,
+				IPFSHost:            ipfsHost,
+				IPFSGateway:         ipfsGateway,
+				GatewayTimeout:      gatewayTimeout,
+				GatewayRace:         gatewayRace,
+				CIDResolvers:        cidResolvers,
+				CIDStorePath:        cidStorePath,
+				ResolverTTL:         resolverTTL,
+				ResolverNegativeTTL: resolverNegativeTTL,
+				ResolverToken:       resolverToken,
+				ResolverPrecedence:  resolverPrecedence,
+				ResolverAuthority:   authority,
+				BlobIndexPath:       blobIndexPath,
+				UploadDir:           uploadDir,
+				UploadTTL:           uploadTTL,
+				DisableDelete:       disableDelete,
+				UnpinOnDelete:       unpinOnDelete,
+				AuthHtpasswd:        authHtpasswd,
+				AuthKeyPath:         authKeyPath,
+				AuthRealm:           authRealm,
+				AuthService:         authService,
+				AuthPolicy:          authPolicy,
+				Upstream:            upstream,
+				UpstreamTTL:         upstreamTTL,
+				TrustlessGateway:    trustlessGateway,
+				ContentSource:       contentSource,
+				CacheDir:            cacheDir,
+				CacheSize:           cacheSize << 20,
+				TLSKeyPath:          tlsKeyPath,
+				TLSCertPath:         tlsCertPath,
 			})
 
 			return srv.Start()
@@ -161,8 +241,10 @@ More info: https://github.com/miguelmota/ipdr`,
 	}
 
 	defaultCIDStore, _ := os.UserHomeDir()
+	defaultBlobIndex := defaultCIDStore
 	if defaultCIDStore != "" {
 		defaultCIDStore = filepath.Join(defaultCIDStore, ".ipdr/cids")
+		defaultBlobIndex = filepath.Join(defaultBlobIndex, ".ipdr/blobs")
 	}
 
 	serverCmd.Flags().BoolVarP(&silent, "silent", "s", false, "Silent flag suppresses logs")
@@ -170,9 +252,32 @@ More info: https://github.com/miguelmota/ipdr`,
 	serverCmd.Flags().StringVarP(&tlsCertPath, "tlsCertPath", "", "", "The path to the .crt file for TLS")
 	serverCmd.Flags().StringVarP(&tlsKeyPath, "tlsKeyPath", "", "", "The path to the .key file for TLS")
 	serverCmd.Flags().StringVarP(&ipfsHost, "ipfs-host", "", "127.0.0.1:5001", "A remote IPFS API host to pull the image from. Eg. 127.0.0.1:5001")
-	serverCmd.Flags().StringVarP(&ipfsGateway, "ipfs-gateway", "g", "127.0.0.1:8080", "The readonly IPFS Gateway URL to pull the image from. Eg. https://ipfs.io")
-	serverCmd.Flags().StringArrayVar(&cidResolvers, "cid-resolver", []string{"file:" + defaultCIDStore}, "Map repo:reference to CID. Accepts dnslink, IPFS path, and local file path.")
+	serverCmd.Flags().StringVarP(&ipfsGateway, "ipfs-gateway", "g", "127.0.0.1:8080", "The readonly IPFS Gateway URL to pull the image from, or a comma separated list of gateways used with failover. Eg. https://ipfs.io")
+	serverCmd.Flags().DurationVar(&gatewayTimeout, "gateway-timeout", 30*time.Second, "How long an IPFS gateway has to respond before the next one is tried")
+	serverCmd.Flags().IntVar(&gatewayRace, "gateway-race", 0, "Send requests to this many IPFS gateways at once and use the fastest response")
+	serverCmd.Flags().BoolVar(&trustlessGateway, "trustless-gateway", false, "Fetch content from the IPFS gateway as raw blocks and verify them against their CID. Allows untrusted public gateways")
+	serverCmd.Flags().StringVar(&contentSource, "content-source", "gateway", "Where manifests and blobs are read from: gateway or api (the IPFS HTTP API of --ipfs-host). The other one is used when it fails")
+	serverCmd.Flags().StringArrayVar(&cidResolvers, "cid-resolver", []string{"file:" + defaultCIDStore}, "Map repo:reference to CID. Accepts dnslink, IPFS path, IPNS name (/ipns/<key>), http(s) URL of a JSON index (.json) or of per-reference paths, and local file path.")
 	serverCmd.Flags().StringVar(&cidStorePath, "cid-store", defaultCIDStore, "CID local store location")
+	serverCmd.Flags().DurationVar(&resolverTTL, "resolver-ttl", 5*time.Minute, "How long resolved DNSLink and IPNS roots are used before they are resolved again")
+	serverCmd.Flags().StringVar(&resolverToken, "cid-resolver-token", os.Getenv("IPDR_CID_RESOLVER_TOKEN"), "Bearer token sent to http(s) CID resolvers. Defaults to $IPDR_CID_RESOLVER_TOKEN")
+	serverCmd.Flags().StringVar(&resolverPrecedence, "cid-resolver-precedence", "first", "How the answers of the CID resolvers are combined: first (the first resolver with an answer wins) or agree (resolvers with an answer must agree)")
+	serverCmd.Flags().StringArrayVar(&resolverAuthority, "cid-resolver-authority", nil, "Make a CID resolver authoritative for the repos matching a glob. Eg. team/*=file:/srv/cids")
+	serverCmd.Flags().DurationVar(&resolverNegativeTTL, "resolver-negative-ttl", 30*time.Second, "How long a failed DNSLink or IPNS resolution is cached")
+	serverCmd.Flags().StringVar(&blobIndexPath, "blob-index", defaultBlobIndex, "Blob metadata (digest to size, media type and the CIDs holding the blob) local store location")
+	serverCmd.Flags().StringVar(&cacheDir, "cache-dir", "", "Opt-in disk cache: directory blobs and manifests read from IPFS are cached in by digest, shared by every repo and kept across restarts, eg. ~/.ipdr/cache. The cache is disabled by default")
+	serverCmd.Flags().Int64Var(&cacheSize, "cache-size", 10240, "Size budget of the cache in MiB when --cache-dir is set, the least recently used content is evicted above it")
+	serverCmd.Flags().StringVar(&uploadDir, "upload-dir", "", "Scratch directory that blob uploads are spooled to. Defaults to the system temp directory")
+	serverCmd.Flags().DurationVar(&uploadTTL, "upload-ttl", time.Hour, "How long an idle blob upload session, or an uploaded blob no manifest references, is kept before it expires")
+	serverCmd.Flags().BoolVar(&disableDelete, "disable-delete", false, "Reject manifest and tag deletion")
+	serverCmd.Flags().BoolVar(&unpinOnDelete, "unpin-on-delete", false, "Unpin the image CID on the IPFS node when its last tag is deleted")
+	serverCmd.Flags().StringVar(&authHtpasswd, "auth-htpasswd", "", "htpasswd file (bcrypt) of the users allowed to log in. Enables token authentication")
+	serverCmd.Flags().StringVar(&authKeyPath, "auth-key", "", "File containing the key tokens are signed with. A random key is generated when not set")
+	serverCmd.Flags().StringVar(&authRealm, "auth-realm", "", "Token endpoint advertised to clients. Defaults to the /token endpoint of the registry")
+	serverCmd.Flags().StringVar(&authService, "auth-service", "ipdr", "Service name tokens are issued for")
+	serverCmd.Flags().StringVar(&upstream, "upstream", "", "Registry to mirror images from when they can't be resolved, adding them to IPFS. Eg. https://registry-1.docker.io")
+	serverCmd.Flags().DurationVar(&upstreamTTL, "upstream-ttl", 5*time.Minute, "How long a mirrored tag is served from IPFS before it's checked against the upstream registry again")
+	serverCmd.Flags().StringVar(&authPolicy, "auth-policy", "", "JSON policy file granting users and groups read, write and delete on repository globs. Reloaded on change")
 
 	convertCmd := &cobra.Command{
 		Use:   "convert",
@@ -2,6 +2,8 @@ package docker
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,13 +18,18 @@ import (
 
 // Client is client structure
 type Client struct {
-	client *client.Client
-	debug  bool
+	client   *client.Client
+	debug    bool
+	username string
+	password string
 }
 
 // Config is client config
 type Config struct {
 	Debug bool
+	// Username and Password are the registry credentials used on push and pull
+	Username string
+	Password string
 }
 
 // NewClient creates a new client instance
@@ -43,8 +50,10 @@ func newEnvClient(config *Config) *Client {
 	cl.NegotiateAPIVersion(ctx)
 
 	return &Client{
-		client: cl,
-		debug:  config.Debug,
+		client:   cl,
+		debug:    config.Debug,
+		username: config.Username,
+		password: config.Password,
 	}
 }
 
@@ -97,7 +106,13 @@ func (c *Client) HasImage(imageID string) (bool, error) {
 
 // PullImage pulls a docker image
 func (c *Client) PullImage(imageID string) error {
-	reader, err := c.client.ImagePull(context.Background(), imageID, types.ImagePullOptions{})
+	auth, err := c.registryAuth()
+	if err != nil {
+		return err
+	}
+	reader, err := c.client.ImagePull(context.Background(), imageID, types.ImagePullOptions{
+		RegistryAuth: auth,
+	})
 	if err != nil {
 		return fmt.Errorf("[docker] error pulling image: %v", err)
 	}
@@ -110,9 +125,12 @@ func (c *Client) PullImage(imageID string) error {
 
 // PushImage pushes a docker image
 func (c *Client) PushImage(imageID string) error {
+	auth, err := c.registryAuth()
+	if err != nil {
+		return err
+	}
 	reader, err := c.client.ImagePush(context.Background(), imageID, types.ImagePushOptions{
-		// NOTE: if no auth, then any value is required
-		RegistryAuth: "123",
+		RegistryAuth: auth,
 	})
 	if err != nil {
 		return err
@@ -125,6 +143,19 @@ func (c *Client) PushImage(imageID string) error {
 	return nil
 }
 
+// registryAuth returns the base64 encoded credentials expected by the docker daemon.
+// The daemon requires a value even for anonymous access, which is an empty JSON object.
+func (c *Client) registryAuth() (string, error) {
+	b, err := json.Marshal(types.AuthConfig{
+		Username: c.username,
+		Password: c.password,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
 // TagImage tags an image
 func (c *Client) TagImage(imageID, tag string) error {
 	return c.client.ImageTag(context.Background(), imageID, tag)
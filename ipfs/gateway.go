@@ -0,0 +1,270 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miguelmota/ipdr/netutil"
+)
+
+// GatewaySet is a list of IPFS gateways used with failover.
+// Gateways that fail are skipped until their cooldown expires,
+// the others are tried in order of their observed latency.
+type GatewaySet struct {
+	gateways []*gateway
+	timeout  time.Duration
+	cooldown time.Duration
+	race     int
+
+	lock sync.Mutex
+}
+
+type gateway struct {
+	url string
+	// moving average of the time to the response headers
+	latency time.Duration
+	// consecutive failures
+	failures  int
+	downUntil time.Time
+	lastError string
+}
+
+// GatewayOptions configures the gateway set
+type GatewayOptions struct {
+	// Timeout is how long a gateway has to respond, and how long the body may stall.
+	// Defaults to netutil.DefaultIdleTimeout
+	Timeout time.Duration
+	// Cooldown is how long a failing gateway is skipped, doubled for every consecutive failure up to 32 times.
+	// Defaults to 30 seconds
+	Cooldown time.Duration
+	// Race is the number of gateways a request is sent to at once, the first response wins.
+	// Gateways are only tried one after the other when less than 2
+	Race int
+}
+
+// GatewayStatus is the health of a gateway
+type GatewayStatus struct {
+	URL       string        `json:"url"`
+	Healthy   bool          `json:"healthy"`
+	Latency   time.Duration `json:"latency,omitempty"`
+	Failures  int           `json:"failures,omitempty"`
+	DownUntil time.Time     `json:"down_until,omitempty"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// ParseGatewayURLs returns the normalized URLs of a comma separated list of gateways
+func ParseGatewayURLs(list string) []string {
+	var urls []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			urls = append(urls, NormalizeGatewayURL(s))
+		}
+	}
+	return urls
+}
+
+// NewGatewaySet returns the gateway set of the URLs, which are used as is
+func NewGatewaySet(urls []string, opts *GatewayOptions) *GatewaySet {
+	if opts == nil {
+		opts = &GatewayOptions{}
+	}
+	s := &GatewaySet{
+		timeout:  opts.Timeout,
+		cooldown: opts.Cooldown,
+		race:     opts.Race,
+	}
+	if s.timeout <= 0 {
+		s.timeout = netutil.DefaultIdleTimeout
+	}
+	if s.cooldown <= 0 {
+		s.cooldown = 30 * time.Second
+	}
+	for _, u := range urls {
+		s.gateways = append(s.gateways, &gateway{url: strings.TrimRight(u, "/")})
+	}
+	return s
+}
+
+// URLs returns the gateway URLs in order of preference
+func (s *GatewaySet) URLs() []string {
+	var urls []string
+	for _, g := range s.ordered() {
+		urls = append(urls, g.url)
+	}
+	return urls
+}
+
+// Status returns the health of every gateway in the configured order
+func (s *GatewaySet) Status() []GatewayStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	var list []GatewayStatus
+	for _, g := range s.gateways {
+		list = append(list, GatewayStatus{
+			URL:       g.url,
+			Healthy:   !now.Before(g.downUntil),
+			Latency:   g.latency,
+			Failures:  g.failures,
+			DownUntil: g.downUntil,
+			LastError: g.lastError,
+		})
+	}
+	return list
+}
+
+// Do sends the request for the path under /ipfs/, e.g. <cid>/blobs/<digest>, to the gateways
+// until one responds without a server error. A 4xx response is returned as is.
+// Callers need to close the response body after usage.
+func (s *GatewaySet) Do(method, p string, header http.Header) (*http.Response, error) {
+	gateways := s.ordered()
+	if len(gateways) == 0 {
+		return nil, fmt.Errorf("no IPFS gateway")
+	}
+
+	var lastErr error
+	if s.race > 1 && len(gateways) > 1 {
+		n := s.race
+		if n > len(gateways) {
+			n = len(gateways)
+		}
+		resp, err := s.raceDo(gateways[:n], method, p, header)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		gateways = gateways[n:]
+	}
+
+	for _, g := range gateways {
+		resp, err := s.do(context.Background(), g, method, p, header)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// raceDo sends the request to every gateway at once and returns the first good response
+func (s *GatewaySet) raceDo(gateways []*gateway, method, p string, header http.Header) (*http.Response, error) {
+	type result struct {
+		i    int
+		resp *http.Response
+		err  error
+	}
+	results := make(chan result, len(gateways))
+	cancels := make([]context.CancelFunc, len(gateways))
+	for i, g := range gateways {
+		var ctx context.Context
+		ctx, cancels[i] = context.WithCancel(context.Background())
+		go func(i int, g *gateway) {
+			resp, err := s.do(ctx, g, method, p, header)
+			results <- result{i, resp, err}
+		}(i, g)
+	}
+
+	var lastErr error
+	for n := len(gateways); n > 0; n-- {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		// cancel the losers, the winner's context is released with its body
+		for i, cancel := range cancels {
+			if i != r.i {
+				cancel()
+			}
+		}
+		go func(n int) {
+			for ; n > 0; n-- {
+				if l := <-results; l.resp != nil {
+					l.resp.Body.Close()
+				}
+			}
+		}(n - 1)
+		return r.resp, nil
+	}
+	return nil, lastErr
+}
+
+// do sends the request to the gateway and records the outcome.
+// Server errors are returned as errors.
+func (s *GatewaySet) do(ctx context.Context, g *gateway, method, p string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, g.url+"/ipfs/"+strings.TrimPrefix(p, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	start := time.Now()
+	resp, err := netutil.Stream(req, s.timeout)
+	if err == nil && resp.StatusCode >= 500 {
+		resp.Body.Close()
+		err = fmt.Errorf("%s: %s", g.url, resp.Status)
+	}
+	if err != nil {
+		// losing a race is not a failure of the gateway
+		if ctx.Err() == nil {
+			s.fail(g, err)
+		}
+		return nil, err
+	}
+	s.succeed(g, time.Since(start))
+	return resp, nil
+}
+
+func (s *GatewaySet) fail(g *gateway, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	g.failures++
+	backoff := g.failures - 1
+	if backoff > 5 {
+		backoff = 5
+	}
+	g.downUntil = time.Now().Add(s.cooldown << uint(backoff))
+	g.lastError = err.Error()
+}
+
+func (s *GatewaySet) succeed(g *gateway, latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	g.failures = 0
+	g.downUntil = time.Time{}
+	if g.latency == 0 {
+		g.latency = latency
+	} else {
+		g.latency = (3*g.latency + latency) / 4
+	}
+}
+
+// ordered returns the healthy gateways by latency followed by the failing ones,
+// which are still tried as a last resort
+func (s *GatewaySet) ordered() []*gateway {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	list := make([]*gateway, len(s.gateways))
+	copy(list, s.gateways)
+	sort.SliceStable(list, func(i, j int) bool {
+		di, dj := now.Before(list[i].downUntil), now.Before(list[j].downUntil)
+		if di != dj {
+			return dj
+		}
+		if di {
+			return list[i].downUntil.Before(list[j].downUntil)
+		}
+		// gateways without samples yet come first so that they get one
+		return list[i].latency < list[j].latency
+	})
+	return list
+}
@@ -0,0 +1,95 @@
+package ipfs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestGateway(status int, delay time.Duration, body string) (*httptest.Server, *int32) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	return srv, &hits
+}
+
+func TestGatewayFailover(t *testing.T) {
+	down, downHits := newTestGateway(http.StatusBadGateway, 0, "")
+	defer down.Close()
+	slow, _ := newTestGateway(http.StatusOK, time.Second, "slow")
+	defer slow.Close()
+	up, _ := newTestGateway(http.StatusOK, 0, "up")
+	defer up.Close()
+
+	gs := NewGatewaySet([]string{down.URL, slow.URL, up.URL}, &GatewayOptions{Timeout: 100 * time.Millisecond})
+	for i := 0; i < 2; i++ {
+		resp, err := gs.Do("GET", "cid/file", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "up" {
+			t.Fatalf("expected up; got %s", b)
+		}
+	}
+	if hits := atomic.LoadInt32(downHits); hits != 1 {
+		t.Fatalf("expected the failing gateway to be skipped; got %d hits", hits)
+	}
+	if urls := gs.URLs(); urls[0] != up.URL {
+		t.Fatalf("expected the healthy gateway first; got %v", urls)
+	}
+	st := gs.Status()
+	if st[0].Healthy || st[0].LastError == "" || st[1].Healthy || !st[2].Healthy {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	// 4xx is an answer
+	notFound, _ := newTestGateway(http.StatusNotFound, 0, "")
+	defer notFound.Close()
+	gs = NewGatewaySet([]string{notFound.URL, up.URL}, nil)
+	resp, err := gs.Do("GET", "cid/file", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d; got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestGatewayRace(t *testing.T) {
+	slow, _ := newTestGateway(http.StatusOK, time.Second, "slow")
+	defer slow.Close()
+	fast, _ := newTestGateway(http.StatusOK, 10*time.Millisecond, "fast")
+	defer fast.Close()
+
+	gs := NewGatewaySet([]string{slow.URL, fast.URL}, &GatewayOptions{Race: 2})
+	start := time.Now()
+	resp, err := gs.Do("GET", "cid/file", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "fast" {
+		t.Fatalf("expected fast; got %s", b)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("expected the fastest response; took %s", d)
+	}
+	if st := gs.Status(); !st[0].Healthy {
+		t.Fatalf("expected the loser to stay healthy; got %+v", st[0])
+	}
+}
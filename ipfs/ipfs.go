@@ -25,12 +25,18 @@ type Client struct {
 	isRemote   bool
 	host       string
 	gatewayURL string
+	gateways   *GatewaySet
 }
 
 // Config is the config for the client
 type Config struct {
-	Host       string
+	Host string
+	// GatewayURL is a gateway URL or a comma separated list of gateway URLs used with failover
 	GatewayURL string
+	// GatewayTimeout is how long a gateway has to respond before the next one is tried
+	GatewayTimeout time.Duration
+	// GatewayRace is the number of gateways a request is sent to at once
+	GatewayRace int
 }
 
 // NewClient returns a new IPFS client instance
@@ -68,12 +74,19 @@ func NewRemoteClient(config *Config) *Client {
 		}
 	}
 
-	return &Client{
+	c := &Client{
 		client:     client,
 		isRemote:   true,
 		host:       host,
 		gatewayURL: config.GatewayURL,
 	}
+	if urls := ParseGatewayURLs(config.GatewayURL); len(urls) > 0 {
+		c.gateways = NewGatewaySet(urls, &GatewayOptions{
+			Timeout: config.GatewayTimeout,
+			Race:    config.GatewayRace,
+		})
+	}
+	return c
 }
 
 // Cat the content at the given path. Callers need to drain and close the returned reader after usage.
@@ -81,6 +94,24 @@ func (client *Client) Cat(path string) (io.ReadCloser, error) {
 	return client.client.Cat(path)
 }
 
+// CatRange streams length bytes of the content at the given path starting at offset, or the rest of it when length is negative.
+// Callers need to drain and close the returned reader after usage.
+// https://docs.ipfs.io/reference/http/api/#api-v0-cat
+func (client *Client) CatRange(path string, offset, length int64) (io.ReadCloser, error) {
+	req := client.client.Request("cat", path).Option("offset", offset)
+	if length >= 0 {
+		req = req.Option("length", length)
+	}
+	resp, err := req.Send(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp.Output, nil
+}
+
 // Get fetches the contents and outputs into a directory
 func (client *Client) Get(hash, outdir string) error {
 	return client.client.Get(hash, outdir)
@@ -91,6 +122,37 @@ func (client *Client) List(path string) ([]*api.LsLink, error) {
 	return client.client.List(path)
 }
 
+// Unpin removes the recursive pin of the given path so its blocks can be garbage collected
+func (client *Client) Unpin(path string) error {
+	return client.client.Unpin(path)
+}
+
+// ResolveName resolves the IPNS name, e.g. /ipns/<key>, to an /ipfs/ path
+func (client *Client) ResolveName(name string) (string, error) {
+	return client.client.Resolve(strings.TrimPrefix(name, "/ipns/"))
+}
+
+// Stat is the unixfs stat of an IPFS path
+type Stat struct {
+	Hash           string
+	Size           uint64
+	CumulativeSize uint64
+	Blocks         int
+	Type           string
+}
+
+// Stat returns the stat of the given IPFS path without fetching its content
+// https://docs.ipfs.io/reference/http/api/#api-v0-files-stat
+func (client *Client) Stat(path string) (*Stat, error) {
+	var out Stat
+	err := client.client.Request("files/stat", "/ipfs/"+strings.TrimPrefix(path, "/ipfs/")).
+		Exec(context.Background(), &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
 // AddDir adds a directory to IPFS
 // https://github.com/ipfs/go-ipfs-api/blob/master/add.go#L99-L145
 func (client *Client) AddDir(dir string) (string, error) {
@@ -151,16 +213,28 @@ func (client *Client) Refs(hash string, recursive bool) (<-chan string, error) {
 	return client.client.Refs(hash, recursive)
 }
 
-// GatewayURL returns the gateway URL
+// GatewayURL returns the gateway URL, the preferred healthy one when several are configured
 func (client *Client) GatewayURL() string {
+	return client.GatewayURLs()[0]
+}
+
+// GatewayURLs returns the gateway URLs in order of preference
+func (client *Client) GatewayURLs() []string {
 	if client.gatewayURL == "" {
 		url, err := HostGatewayURL()
 		if err == nil {
-			return url
+			return []string{url}
 		}
 	}
+	if client.gateways == nil {
+		return []string{NormalizeGatewayURL(client.gatewayURL)}
+	}
+	return client.gateways.URLs()
+}
 
-	return NormalizeGatewayURL(client.gatewayURL)
+// Gateways returns the gateway set, nil when no gateway is configured
+func (client *Client) Gateways() *GatewaySet {
+	return client.gateways
 }
 
 // remoteRefs returns refs using the IPFS API
@@ -205,16 +279,33 @@ type object struct {
 	Hash string
 }
 
-// AddImage adds components of an image recursively
-func (client *Client) AddImage(manifest map[string][]byte, layers map[string][]byte) (string, error) {
+// AddImage adds components of an image recursively.
+// Layers map the blob digest to the path of the blob on disk, which is streamed to IPFS,
+// or to the /ipfs/ path of a blob already in IPFS, which is linked into the image directory
+// without transferring its content.
+func (client *Client) AddImage(manifest map[string][]byte, layers map[string]string) (string, error) {
 	mf := make(map[string]files.Node)
 	for k, v := range manifest {
 		mf[k] = files.NewBytesFile(v)
 	}
 
 	bf := make(map[string]files.Node)
-	for k, v := range layers {
-		bf[k] = files.NewBytesFile(v)
+	links := make(map[string]string)
+	for k, p := range layers {
+		if strings.HasPrefix(p, "/ipfs/") {
+			links[k] = p
+			continue
+		}
+		stat, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		f, err := files.NewSerialFile(p, false, stat)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		bf[k] = f
 	}
 
 	sf := files.NewMapDirectory(map[string]files.Node{
@@ -230,7 +321,7 @@ func (client *Client) AddImage(manifest map[string][]byte, layers map[string][]b
 		Body(reader).
 		Send(context.Background())
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	defer resp.Close()
@@ -257,7 +348,36 @@ func (client *Client) AddImage(manifest map[string][]byte, layers map[string][]b
 		return "", errors.New("no results received")
 	}
 
-	return final, nil
+	if len(links) == 0 {
+		return final, nil
+	}
+	return client.linkBlobs(final, links)
+}
+
+// linkBlobs links blobs already in IPFS into the blobs directory of the image root.
+// The resulting root is pinned in place of the original one.
+// https://docs.ipfs.io/reference/http/api/#api-v0-object-patch-add-link
+func (client *Client) linkBlobs(root string, links map[string]string) (string, error) {
+	newRoot := root
+	for k, p := range links {
+		hash, err := client.client.ResolvePath(p)
+		if err != nil {
+			return "", err
+		}
+		newRoot, err = client.client.PatchLink(newRoot, "blobs/"+k, hash, true)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := client.client.Pin(newRoot); err != nil {
+		return "", err
+	}
+	if err := client.client.Unpin(root); err != nil {
+		log.Warnf("[ipfs] unpin %s: %v", root, err)
+	}
+
+	return newRoot, nil
 }
 
 // RunDaemon runs the IPFS daemon
@@ -302,8 +422,11 @@ func spawnIpfsDaemon(ready chan bool) error {
 	return nil
 }
 
-// NormalizeGatewayURL normalizes IPFS gateway URL
+// NormalizeGatewayURL normalizes IPFS gateway URL, or every URL of a comma separated list
 func NormalizeGatewayURL(urlstr string) string {
+	if strings.Contains(urlstr, ",") {
+		return strings.Join(ParseGatewayURLs(urlstr), ",")
+	}
 	if !strings.HasPrefix(urlstr, "http") {
 		urlstr = "http://" + urlstr
 	}
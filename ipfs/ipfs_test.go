@@ -56,6 +56,7 @@ func TestNormalizeGatewayURL(t *testing.T) {
 		{"127.0.0.1:8080", "http://127.0.0.1:8080"},
 		{"http://123.123.123.123:8080", "http://123.123.123.123:8080"},
 		{"", "http://ipfs.io"},
+		{"127.0.0.1:8080, ipfs.io", "http://127.0.0.1:8080,http://ipfs.io"},
 	} {
 		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
 			got := NormalizeGatewayURL(tt.in)
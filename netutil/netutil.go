@@ -1,7 +1,9 @@
 package netutil
 
 import (
+	"context"
 	"errors"
+	"io"
 	"net"
 	"net/http"
 	"regexp"
@@ -32,11 +34,63 @@ var defaultTransport = &http.Transport{
 	ExpectContinueTimeout: 1 * time.Second,
 }
 
+// Stream client has no overall timeout so that large bodies can be streamed,
+// stalled transfers are detected by the idle timeout of Stream instead.
+var streamClient = &http.Client{
+	Transport: defaultTransport,
+}
+
+// DefaultIdleTimeout is the default time Stream waits for data before giving up.
+var DefaultIdleTimeout = 30 * time.Second
+
 // Get issues a GET to the specified URL - a drop-in replacement for http.Get with timeouts.
 func Get(url string) (resp *http.Response, err error) {
 	return defaultClient.Get(url)
 }
 
+// Stream sends the request without a limit on the total duration.
+// The request is canceled if no response or body data arrives for the idle duration.
+// Callers need to close the response body after usage.
+func Stream(req *http.Request, idle time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(idle, cancel)
+	resp, err := streamClient.Do(req.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	resp.Body = &idleReader{
+		ReadCloser: resp.Body,
+		timer:      timer,
+		idle:       idle,
+		cancel:     cancel,
+	}
+	return resp, nil
+}
+
+// idleReader pushes back the idle deadline on every read.
+type idleReader struct {
+	io.ReadCloser
+	timer  *time.Timer
+	idle   time.Duration
+	cancel context.CancelFunc
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.idle)
+	}
+	return n, err
+}
+
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
 // GetFreePort asks the kernel for a free open port that is ready to use.
 func GetFreePort() (int, error) {
 	ip, err := LocalIP()
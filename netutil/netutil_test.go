@@ -2,9 +2,13 @@ package netutil
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestGetFreePort(t *testing.T) {
@@ -64,3 +68,43 @@ func TestExtractPort(t *testing.T) {
 		})
 	}
 }
+
+func TestStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// slow but steady transfer outlasting the idle timeout
+		for i := 0; i < 4; i++ {
+			fmt.Fprint(w, "x")
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+		if r.URL.Path == "/stall" {
+			time.Sleep(time.Second)
+		}
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := Stream(req, 150*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "xxxx" {
+		t.Errorf("want xxxx, got %s", b)
+	}
+
+	req, _ = http.NewRequest("GET", srv.URL+"/stall", nil)
+	resp, err = Stream(req, 150*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		t.Error("expected idle timeout error")
+	}
+}
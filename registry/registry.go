@@ -22,6 +22,7 @@ import (
 	ipfs "github.com/miguelmota/ipdr/ipfs"
 	netutil "github.com/miguelmota/ipdr/netutil"
 	server "github.com/miguelmota/ipdr/server"
+	image "github.com/miguelmota/ipdr/server/registry/image"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -30,15 +31,28 @@ type Registry struct {
 	dockerLocalRegistryHost string
 	dockerClient            *docker.Client
 	ipfsClient              *ipfs.Client
+	manifestFormat          string
 	debug                   bool
 }
 
+// Manifest formats produced on push
+const (
+	// ManifestFormatDocker is the Docker image manifest v2, schema 2
+	ManifestFormatDocker = "docker"
+	// ManifestFormatOCI is the OCI image manifest
+	ManifestFormatOCI = "oci"
+)
+
 // Config is the config for the registry
 type Config struct {
 	DockerLocalRegistryHost string
 	IPFSHost                string
 	IPFSGateway             string
-	Debug                   bool
+	ManifestFormat          string
+	// Username and Password are the credentials of the registry server pushed to and pulled from, if it requires a login
+	Username string
+	Password string
+	Debug    bool
 }
 
 // NewRegistry returns a new registry client instance
@@ -65,13 +79,21 @@ func NewRegistry(config *Config) *Registry {
 		GatewayURL: config.IPFSGateway,
 	})
 	dockerClient := docker.NewClient(&docker.Config{
-		Debug: config.Debug,
+		Debug:    config.Debug,
+		Username: config.Username,
+		Password: config.Password,
 	})
 
+	manifestFormat := config.ManifestFormat
+	if manifestFormat == "" {
+		manifestFormat = ManifestFormatDocker
+	}
+
 	return &Registry{
 		dockerLocalRegistryHost: dockerLocalRegistryHost,
 		ipfsClient:              ipfsClient,
 		dockerClient:            dockerClient,
+		manifestFormat:          manifestFormat,
 		debug:                   config.Debug,
 	}
 }
@@ -203,7 +225,7 @@ func (r *Registry) runServer() {
 		srv := server.NewServer(&server.Config{
 			Port:        netutil.ExtractPort(r.dockerLocalRegistryHost),
 			Debug:       r.debug,
-			IPFSGateway: r.ipfsClient.GatewayURL(),
+			IPFSGateway: strings.Join(r.ipfsClient.GatewayURLs(), ","),
 		})
 		go srv.Start()
 	}
@@ -416,6 +438,7 @@ func writeJSON(idate interface{}, path string) error {
 }
 
 // produce v2 manifest of type/application/vnd.docker.distribution.manifest.v2+json
+// or application/vnd.oci.image.manifest.v1+json depending on the manifest format
 func (r *Registry) makeV2Manifest(manifest map[string]interface{}, configDigest, configDest, tmp, workdir string) (map[string]interface{}, error) {
 	v2manifest, err := r.prepareV2Manifest(manifest, tmp, workdir+"/blobs")
 	if err != nil {
@@ -427,7 +450,10 @@ func (r *Registry) makeV2Manifest(manifest map[string]interface{}, configDigest,
 	if err != nil {
 		return nil, err
 	}
-	config["mediaType"] = "application/vnd.docker.container.image.v1+json"
+	config["mediaType"] = image.ConfigType
+	if r.manifestFormat == ManifestFormatOCI {
+		config["mediaType"] = image.OCIConfigType
+	}
 	conf, ok := v2manifest["config"].(map[string]interface{})
 	if !ok {
 		return nil, errors.New("not ok")
@@ -448,11 +474,15 @@ func mergemap(a, b map[string]interface{}) map[string]interface{} {
 func (r *Registry) prepareV2Manifest(mf map[string]interface{}, tmp, blobDir string) (map[string]interface{}, error) {
 	res := make(map[string]interface{})
 	res["schemaVersion"] = 2
-	res["mediaType"] = "application/vnd.docker.distribution.manifest.v2+json"
+	res["mediaType"] = image.ManifestType
+	mediaType := image.LayerType
+	if r.manifestFormat == ManifestFormatOCI {
+		res["mediaType"] = image.OCIManifestType
+		mediaType = image.OCILayerGzipType
+	}
 	config := make(map[string]interface{})
 	res["config"] = config
 	var layers []map[string]interface{}
-	mediaType := "application/vnd.docker.image.rootfs.diff.tar.gzip"
 	ls, ok := mf["Layers"].([]interface{})
 	if !ok {
 		return nil, errors.New("expected layers")
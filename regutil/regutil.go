@@ -42,11 +42,6 @@ func IpfsifyHash(base32Hash string) string {
 	return base58.Encode(decodedB32)
 }
 
-// IpfsURL constructs IPFS gateway URL
-func IpfsURL(gw string, s []string) string {
-	return fmt.Sprintf("%s/ipfs/%s", gw, strings.Join(s, "/"))
-}
-
 func toCidV0(c cid.Cid) (cid.Cid, error) {
 	if c.Type() != cid.DagProtobuf {
 		return cid.Cid{}, fmt.Errorf("can't convert non-protobuf nodes to cidv0")
@@ -0,0 +1,345 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// https://docs.docker.com/registry/spec/auth/token/
+
+// htpasswd contains the users of an htpasswd file. The file is reloaded when it changes.
+// Only bcrypt hashes are supported, as generated by `htpasswd -B`
+type htpasswd struct {
+	path    string
+	modTime time.Time
+	users   map[string][]byte
+
+	sync.Mutex
+}
+
+func newHtpasswd(path string) *htpasswd {
+	return &htpasswd{
+		path:  path,
+		users: map[string][]byte{},
+	}
+}
+
+// authenticate returns whether the password matches the one of the user
+func (h *htpasswd) authenticate(user, password string) (bool, error) {
+	h.Lock()
+	err := h.load()
+	hash, ok := h.users[user]
+	h.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, nil
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil, nil
+}
+
+// load reads the file if it changed since it was last read
+func (h *htpasswd) load() error {
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(h.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid htpasswd entry: %s", line)
+		}
+		users[kv[0]] = []byte(kv[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	h.users = users
+	h.modTime = fi.ModTime()
+	return nil
+}
+
+func isToken(req *http.Request) bool {
+	return req.URL.Path == "/token"
+}
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// token issues a token for the requested scopes to users authenticated with basic auth
+// /token?service=ipdr&scope=repository:foo:pull,push
+func (r *registry) token(resp http.ResponseWriter, req *http.Request) *regError {
+	user, password, ok := req.BasicAuth()
+	if ok {
+		var err error
+		ok, err = r.users.authenticate(user, password)
+		if err != nil {
+			r.log.Printf("htpasswd %s: %v", r.users.path, err)
+		}
+	}
+	if !ok {
+		resp.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", r.tokens.service))
+		return &regError{
+			Status:  http.StatusUnauthorized,
+			Code:    "UNAUTHORIZED",
+			Message: "invalid username or password",
+		}
+	}
+
+	var access []*tokenAccess
+	for _, s := range req.URL.Query()["scope"] {
+		for _, f := range strings.Fields(s) {
+			scope, err := parseScope(f)
+			if err != nil {
+				return &regError{
+					Status:  http.StatusBadRequest,
+					Code:    "UNSUPPORTED",
+					Message: err.Error(),
+				}
+			}
+			access = append(access, r.grant(user, scope))
+		}
+	}
+
+	token, claims, err := r.tokens.issue(user, access)
+	if err != nil {
+		return &regError{
+			Status:  http.StatusInternalServerError,
+			Code:    "UNKNOWN",
+			Message: err.Error(),
+		}
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	json.NewEncoder(resp).Encode(&tokenResponse{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   claims.ExpiresAt - claims.IssuedAt,
+		IssuedAt:    time.Unix(claims.IssuedAt, 0).UTC().Format(time.RFC3339),
+	})
+	return nil
+}
+
+// grant returns the actions of the scope the user is allowed to perform
+func (r *registry) grant(user string, scope *tokenAccess) *tokenAccess {
+	granted := &tokenAccess{
+		Type: scope.Type,
+		Name: scope.Name,
+	}
+	allowed := func(action string) bool {
+		if r.policy == nil || scope.Type != "repository" {
+			return true
+		}
+		ok, err := r.policy.allows(user, scope.Name, action)
+		if err != nil {
+			r.log.Printf("policy %s: %v", r.policy.path, err)
+		}
+		return ok
+	}
+	for _, a := range scope.Actions {
+		switch a {
+		case "pull", "push", "delete":
+			if allowed(a) {
+				granted.Actions = append(granted.Actions, a)
+			}
+		case "*":
+			// all actions, or those of them the policy allows
+			if allowed("pull") && allowed("push") && allowed("delete") {
+				granted.Actions = append(granted.Actions, a)
+				continue
+			}
+			for _, action := range []string{"pull", "push", "delete"} {
+				if allowed(action) {
+					granted.Actions = append(granted.Actions, action)
+				}
+			}
+		}
+	}
+	granted.Actions = uniq(granted.Actions)
+	return granted
+}
+
+// authorize checks the bearer token of the request grants the scope the request requires
+// and returns the user the token was issued to.
+// A challenge pointing to the token endpoint is set on failure.
+func (r *registry) authorize(resp http.ResponseWriter, req *http.Request) (string, *regError) {
+	if r.tokens == nil {
+		return "", nil
+	}
+
+	scope := requiredScope(req)
+	var claims *tokenClaims
+	var err error
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		claims, err = r.tokens.verify(strings.TrimPrefix(h, "Bearer "))
+	}
+	if claims != nil && (scope == nil || claims.allows(scope)) {
+		// mounting from a repository the token can't pull from becomes a regular upload
+		if from := mountSource(req); from != "" {
+			if !claims.allows(&tokenAccess{Type: "repository", Name: from, Actions: []string{"pull"}}) {
+				unmount(req)
+			}
+		}
+		return claims.Subject, nil
+	}
+
+	challenge := fmt.Sprintf("Bearer realm=%q,service=%q", r.realm(req), r.tokens.service)
+	if scope != nil {
+		challenge += fmt.Sprintf(",scope=%q", scope.String())
+	}
+	message := "authentication required"
+	if claims != nil {
+		challenge += `,error="insufficient_scope"`
+		message = fmt.Sprintf("access to %s not granted", scope)
+	} else if err != nil {
+		challenge += `,error="invalid_token"`
+		message = err.Error()
+	}
+	resp.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	resp.Header().Set("WWW-Authenticate", challenge)
+	return "", &regError{
+		Status:  http.StatusUnauthorized,
+		Code:    "UNAUTHORIZED",
+		Message: message,
+	}
+}
+
+// permit checks the access policy allows the user to perform the request
+func (r *registry) permit(user string, req *http.Request) *regError {
+	if r.policy == nil {
+		return nil
+	}
+	scope := requiredScope(req)
+	if scope == nil || scope.Type != "repository" {
+		return nil
+	}
+
+	action := scope.Actions[0]
+	ok, err := r.policy.allows(user, scope.Name, action)
+	if err != nil {
+		r.log.Printf("policy %s: %v", r.policy.path, err)
+	}
+	if !ok {
+		if user == "" {
+			return &regError{
+				Status:  http.StatusUnauthorized,
+				Code:    "UNAUTHORIZED",
+				Message: fmt.Sprintf("anonymous %s of %s not allowed", action, scope.Name),
+			}
+		}
+		return &regError{
+			Status:  http.StatusForbidden,
+			Code:    "DENIED",
+			Message: fmt.Sprintf("%s is not allowed to %s %s", user, action, scope.Name),
+		}
+	}
+
+	if from := mountSource(req); from != "" {
+		if ok, _ := r.policy.allows(user, from, "pull"); !ok {
+			unmount(req)
+		}
+	}
+	return nil
+}
+
+// mountSource returns the repository of a cross repository blob mount request
+func mountSource(req *http.Request) string {
+	if req.Method != "POST" || !isBlob(req) {
+		return ""
+	}
+	return req.URL.Query().Get("from")
+}
+
+// unmount turns a cross repository blob mount request into a regular upload
+func unmount(req *http.Request) {
+	q := req.URL.Query()
+	q.Del("mount")
+	q.Del("from")
+	req.URL.RawQuery = q.Encode()
+}
+
+// realm returns the location of the token endpoint
+func (r *registry) realm(req *http.Request) string {
+	if r.config.AuthRealm != "" {
+		return r.config.AuthRealm
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + req.Host + "/token"
+}
+
+// requiredScope returns the scope needed to serve the request.
+// Any valid token is enough for requests without a scope, e.g. the /v2/ version check.
+func requiredScope(req *http.Request) *tokenAccess {
+	if isCatalog(req) {
+		return &tokenAccess{Type: "registry", Name: "catalog", Actions: []string{"*"}}
+	}
+	// /dig?q=name:tag reads the manifests of the repository
+	if isDig(req) {
+		if name := strings.SplitN(req.URL.Query().Get("q"), ":", 2)[0]; name != "" {
+			return &tokenAccess{Type: "repository", Name: name, Actions: []string{"pull"}}
+		}
+		return nil
+	}
+	repo := repository(req)
+	if repo == "" {
+		return nil
+	}
+	action := "push"
+	switch {
+	case req.Method == "GET" || req.Method == "HEAD":
+		action = "pull"
+	case req.Method == "DELETE" && isManifest(req):
+		action = "delete"
+	}
+	return &tokenAccess{Type: "repository", Name: repo, Actions: []string{action}}
+}
+
+// repository returns the repository name of a blob, manifest or tags request
+func repository(req *http.Request) string {
+	elem := strings.Split(strings.TrimSuffix(req.URL.Path, "/"), "/")
+	elem = elem[1:]
+	switch {
+	case isBlob(req) && elem[len(elem)-3] == "blobs" && elem[len(elem)-2] == "uploads":
+		return strings.Join(elem[1:len(elem)-3], "/")
+	case isBlob(req), isManifest(req), isTags(req):
+		return strings.Join(elem[1:len(elem)-2], "/")
+	}
+	return ""
+}
@@ -0,0 +1,343 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestAuthRegistry returns a test registry with token authentication enabled for the user foo/bar
+func newTestAuthRegistry(t *testing.T, config *Config) (*registry, string, func()) {
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("bar"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("foo:" + string(hash) + "\n")
+	f.Close()
+
+	if config == nil {
+		config = &Config{}
+	}
+	config.AuthHtpasswd = f.Name()
+	r, srv, done := newTestRegistry(t, config)
+	return r, srv.URL, func() {
+		done()
+		os.Remove(f.Name())
+	}
+}
+
+func getToken(t *testing.T, url, user, password, scope string) (string, int) {
+	req, _ := http.NewRequest("GET", url+"/token?service=ipdr&scope="+scope, nil)
+	req.SetBasicAuth(user, password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var tr tokenResponse
+	json.NewDecoder(resp.Body).Decode(&tr)
+	return tr.Token, resp.StatusCode
+}
+
+func doWithToken(t *testing.T, method, url, token string) *http.Response {
+	req, _ := http.NewRequest(method, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestAuthChallenge(t *testing.T) {
+	_, url, done := newTestAuthRegistry(t, nil)
+	defer done()
+
+	resp := doWithToken(t, "GET", url+"/v2/", "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected %d; got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if expected := `Bearer realm="` + url + `/token",service="ipdr"`; challenge != expected {
+		t.Fatalf("expected challenge %s; got %s", expected, challenge)
+	}
+
+	resp = doWithToken(t, "GET", url+"/v2/foo/manifests/latest", "")
+	if challenge := resp.Header.Get("WWW-Authenticate"); !strings.Contains(challenge, `scope="repository:foo:pull"`) {
+		t.Fatalf("expected pull scope in challenge; got %s", challenge)
+	}
+
+	if _, status := getToken(t, url, "foo", "nope", ""); status != http.StatusUnauthorized {
+		t.Fatalf("expected %d; got %d", http.StatusUnauthorized, status)
+	}
+	token, status := getToken(t, url, "foo", "bar", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected %d; got %d", http.StatusOK, status)
+	}
+	if resp := doWithToken(t, "GET", url+"/v2/", token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d; got %d", http.StatusOK, resp.StatusCode)
+	}
+	if resp := doWithToken(t, "GET", url+"/v2/", token+"x"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected tampered token to be rejected; got %d", resp.StatusCode)
+	}
+}
+
+func TestAuthDigStatus(t *testing.T) {
+	_, url, done := newTestAuthRegistry(t, nil)
+	defer done()
+
+	for _, uri := range []string{"/status", "/dig?q=app:v1&explain=true"} {
+		if resp := doWithToken(t, "GET", url+uri, ""); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%s: expected %d; got %d", uri, http.StatusUnauthorized, resp.StatusCode)
+		}
+	}
+
+	token, _ := getToken(t, url, "foo", "bar", "repository:other:pull")
+	if resp := doWithToken(t, "GET", url+"/status", token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d; got %d", http.StatusOK, resp.StatusCode)
+	}
+	resp := doWithToken(t, "GET", url+"/dig?q=app:v1&explain=true", token)
+	if challenge := resp.Header.Get("WWW-Authenticate"); resp.StatusCode != http.StatusUnauthorized || !strings.Contains(challenge, `scope="repository:app:pull"`) {
+		t.Fatalf("expected a pull scope challenge; got %d %s", resp.StatusCode, challenge)
+	}
+
+	token, _ = getToken(t, url, "foo", "bar", "repository:app:pull")
+	if resp := doWithToken(t, "GET", url+"/dig?q=app:v1&explain=true", token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d; got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestAuthScopes(t *testing.T) {
+	_, url, done := newTestAuthRegistry(t, nil)
+	defer done()
+
+	token, _ := getToken(t, url, "foo", "bar", "repository:foo:pull")
+
+	// authorized, but unknown
+	if resp := doWithToken(t, "GET", url+"/v2/foo/tags/list", token); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d; got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	if resp := doWithToken(t, "GET", url+"/v2/other/tags/list", token); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected %d; got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	resp := doWithToken(t, "POST", url+"/v2/foo/blobs/uploads/", token)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected %d; got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if challenge := resp.Header.Get("WWW-Authenticate"); !strings.Contains(challenge, `error="insufficient_scope"`) {
+		t.Fatalf("expected insufficient scope error; got %s", challenge)
+	}
+
+	token, _ = getToken(t, url, "foo", "bar", "repository:foo:pull,push")
+	if resp := doWithToken(t, "POST", url+"/v2/foo/blobs/uploads/", token); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected %d; got %d", http.StatusAccepted, resp.StatusCode)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	issuer := &tokenIssuer{key: []byte("secret"), service: "ipdr", ttl: -time.Second}
+	token, _, err := issuer.issue("foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issuer.verify(token); err != ErrTokenExpired {
+		t.Fatalf("expected %v; got %v", ErrTokenExpired, err)
+	}
+
+	issuer.ttl = time.Minute
+	token, _, _ = issuer.issue("foo", nil)
+	other := &tokenIssuer{key: []byte("other"), service: "ipdr", ttl: time.Minute}
+	if _, err := other.verify(token); err != ErrInvalidToken {
+		t.Fatalf("expected %v; got %v", ErrInvalidToken, err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	f, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	writePolicy := func(s string, mtime time.Time) {
+		if err := ioutil.WriteFile(f.Name(), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(f.Name(), mtime, mtime)
+	}
+	writePolicy(`{
+		"groups": {"team-a": ["foo"]},
+		"rules": [
+			{"subjects": ["team-a"], "repos": ["team-a/*"], "permissions": ["read", "write"]},
+			{"subjects": ["*"], "repos": ["*", "*/*"], "permissions": ["read"]}
+		]
+	}`, time.Now().Add(-time.Minute))
+
+	_, url, done := newTestAuthRegistry(t, &Config{AuthPolicy: f.Name()})
+	defer done()
+
+	teamA, _ := getToken(t, url, "foo", "bar", "repository:team-a/app:pull,push")
+	if resp := doWithToken(t, "POST", url+"/v2/team-a/app/blobs/uploads/", teamA); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected %d; got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	if resp := doWithToken(t, "GET", url+"/v2/team-a/app/tags/list", teamA); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d; got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	// the token only grants the actions the policy allows
+	token, _ := getToken(t, url, "foo", "bar", "repository:team-b/app:pull,push")
+	if resp := doWithToken(t, "GET", url+"/v2/team-b/app/tags/list", token); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d; got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	resp := doWithToken(t, "POST", url+"/v2/team-b/app/blobs/uploads/", token)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected %d; got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if challenge := resp.Header.Get("WWW-Authenticate"); !strings.Contains(challenge, `error="insufficient_scope"`) {
+		t.Fatalf("expected insufficient scope error; got %s", challenge)
+	}
+
+	// reloaded without restart
+	writePolicy(`{"rules": [{"subjects": ["foo"], "repos": ["team-b/*"], "permissions": ["*"]}]}`, time.Now())
+	token, _ = getToken(t, url, "foo", "bar", "repository:team-b/app:pull,push")
+	if resp := doWithToken(t, "POST", url+"/v2/team-b/app/blobs/uploads/", token); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected %d; got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	// tokens issued before the change are checked against the policy too
+	if resp := doWithToken(t, "POST", url+"/v2/team-a/app/blobs/uploads/", teamA); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected %d; got %d", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestPolicyCatalog(t *testing.T) {
+	f, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"rules": [
+		{"subjects": ["foo"], "repos": ["team-a/*"], "permissions": ["read"]},
+		{"subjects": ["*"], "repos": ["public/*"], "permissions": ["read"]}
+	]}`)
+	f.Close()
+
+	catalog := func(url, token string) []string {
+		req, _ := http.NewRequest("GET", url+"/v2/_catalog", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var cr catalogResponse
+		json.NewDecoder(resp.Body).Decode(&cr)
+		return cr.Repositories
+	}
+
+	// policy only, every client is anonymous
+	r, srv, done := newTestRegistry(t, &Config{AuthPolicy: f.Name()})
+	defer done()
+	r.cids.Add("team-a/app", "latest", "bafya")
+	r.cids.Add("public/app", "latest", "bafyp")
+	if repos := catalog(srv.URL, ""); !reflect.DeepEqual(repos, []string{"public/app"}) {
+		t.Fatalf("expected [public/app]; got %v", repos)
+	}
+
+	r, url, done := newTestAuthRegistry(t, &Config{AuthPolicy: f.Name()})
+	defer done()
+	r.cids.Add("team-a/app", "latest", "bafya")
+	r.cids.Add("public/app", "latest", "bafyp")
+	token, _ := getToken(t, url, "foo", "bar", "registry:catalog:*")
+	if repos := catalog(url, token); !reflect.DeepEqual(repos, []string{"public/app", "team-a/app"}) {
+		t.Fatalf("expected [public/app team-a/app]; got %v", repos)
+	}
+}
+
+func TestPolicyNestedRepos(t *testing.T) {
+	f, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"rules": [{"subjects": ["foo"], "repos": ["team-a/*", "team-b/**"], "permissions": ["read"]}]}`)
+	f.Close()
+
+	p := newPolicy(f.Name())
+	for repo, expected := range map[string]bool{
+		"team-a/app":     true,
+		"team-a/app/api": false,
+		"team-b/app":     true,
+		"team-b/app/api": true,
+		"team-b":         false,
+		"team-bb/app":    false,
+	} {
+		if ok, err := p.allows("foo", repo, "pull"); err != nil || ok != expected {
+			t.Fatalf("%s: expected %v; got %v %v", repo, expected, ok, err)
+		}
+	}
+}
+
+func TestPolicyBlobReads(t *testing.T) {
+	f, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"rules": [
+		{"subjects": ["foo"], "repos": ["team-a/*"], "permissions": ["read"]},
+		{"subjects": ["foo"], "repos": ["team-b/*"], "permissions": ["write"]}
+	]}`)
+	f.Close()
+	dir, err := ioutil.TempDir("", "ipdr-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, url, done := newTestAuthRegistry(t, &Config{AuthPolicy: f.Name(), CacheDir: dir})
+	defer done()
+
+	secret := []byte("secret")
+	digest := computeDigest(secret)
+	token, _ := getToken(t, url, "foo", "bar", "repository:team-b/secret:push")
+	req, _ := http.NewRequest("POST", url+"/v2/team-b/secret/blobs/uploads/?digest="+digest, bytes.NewReader(secret))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d; got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	// the blob is in the scratch directory, the cache and the blob index, none of which team-a references
+	if err := r.cache.add(digest, secret); err != nil {
+		t.Fatal(err)
+	}
+	r.index.Add(digest, &blobInfo{Size: int64(len(secret)), CIDs: []string{"bafysecret"}})
+
+	token, _ = getToken(t, url, "foo", "bar", "repository:team-a/anything:pull")
+	for _, method := range []string{"HEAD", "GET"} {
+		if resp := doWithToken(t, method, url+"/v2/team-a/anything/blobs/"+digest, token); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: expected %d; got %d", method, http.StatusNotFound, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// https://github.com/opencontainers/image-spec/blob/master/descriptor.md#digests
+var digestRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+
+func isDigest(s string) bool {
+	return digestRegexp.MatchString(s)
+}
+
+// maxBlobCIDs bounds the CIDs remembered per blob, the most recent ones are kept
+const maxBlobCIDs = 16
+
+// blobInfo is the metadata of a blob.
+type blobInfo struct {
+	Size      int64  `json:"size"`
+	MediaType string `json:"mediaType,omitempty"`
+	// CIDs of the image directories holding the blob, most recent first
+	CIDs []string `json:"cids,omitempty"`
+}
+
+// blobIndex contains metadata of known blobs keyed by digest
+// so blob requests can be answered without fetching the content,
+// and the image directories holding them can be found regardless of the repo.
+type blobIndex struct {
+	entries  map[string]*blobInfo
+	location string
+
+	sync.RWMutex
+}
+
+// Add merges info into the entry of the digest. The media type is kept unless info has one
+// and the CIDs of info are added in front of the known ones.
+func (x *blobIndex) Add(digest string, info *blobInfo) {
+	if !isDigest(digest) {
+		return
+	}
+
+	x.Lock()
+	defer x.Unlock()
+
+	old, ok := x.entries[digest]
+	if !ok {
+		old, _ = x.read(digest)
+	}
+	merged := &blobInfo{
+		Size:      info.Size,
+		MediaType: info.MediaType,
+	}
+	cids := info.CIDs
+	if old != nil {
+		if merged.MediaType == "" {
+			merged.MediaType = old.MediaType
+		}
+		cids = append(append([]string{}, cids...), old.CIDs...)
+	}
+	if cids = uniq(cids); len(cids) > 0 {
+		if len(cids) > maxBlobCIDs {
+			cids = cids[:maxBlobCIDs]
+		}
+		merged.CIDs = cids
+	}
+	if reflect.DeepEqual(old, merged) {
+		return
+	}
+	x.entries[digest] = merged
+	x.write(digest, merged)
+}
+
+func (x *blobIndex) Get(digest string) (*blobInfo, bool) {
+	if !isDigest(digest) {
+		return nil, false
+	}
+
+	x.RLock()
+	info, ok := x.entries[digest]
+	x.RUnlock()
+	if ok {
+		return info, true
+	}
+
+	info, err := x.read(digest)
+	if err != nil {
+		return nil, false
+	}
+
+	x.Lock()
+	x.entries[digest] = info
+	x.Unlock()
+	return info, true
+}
+
+// path returns the location of the entry, e.g. <location>/sha256/<hex>
+func (x *blobIndex) path(digest string) string {
+	return filepath.Join(x.location, strings.Replace(digest, ":", "/", 1))
+}
+
+func (x *blobIndex) read(digest string) (*blobInfo, error) {
+	if x.location == "" {
+		return nil, os.ErrNotExist
+	}
+	b, err := ioutil.ReadFile(x.path(digest))
+	if err != nil {
+		return nil, err
+	}
+	var info blobInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (x *blobIndex) write(digest string, info *blobInfo) error {
+	if x.location == "" {
+		return nil
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	p := x.path(digest)
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, b, 0644)
+}
+
+func newBlobIndex(location string) *blobIndex {
+	return &blobIndex{
+		entries:  map[string]*blobInfo{},
+		location: location,
+	}
+}
@@ -15,19 +15,14 @@
 package registry
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"math/rand"
 	"net/http"
+	"os"
 	"path"
 	"strings"
 	"sync"
-
-	"github.com/miguelmota/ipdr/netutil"
+	"time"
 )
 
 // Returns whether this url should be handled by the blob handler
@@ -47,15 +42,42 @@ func isBlob(req *http.Request) bool {
 		elem[len(elem)-2] == "uploads")
 }
 
+// pendingBlob counts the references to a blob in the scratch directory
+type pendingBlob struct {
+	// uploads and mounts no manifest push has consumed yet
+	refs int
+	// manifest pushes in progress that use the blob
+	pins int
+	last time.Time
+	// repos the blob was uploaded or mounted to
+	repos map[string]bool
+}
+
 // blobs
 type blobs struct {
 	// Blobs are content addresses. we store them globally underneath their sha and make no distinctions per image.
-	contents map[string][]byte
+	// maps digest -> path of the blob in the scratch directory
+	contents map[string]string
 	// Each upload gets a unique id that writes occur to until finalized.
-	uploads map[string][]byte
+	uploads map[string]*upload
 	lock    sync.Mutex
 
-	layers map[string][]string
+	// Blobs mounted from other repos that are already in IPFS.
+	// maps digest -> /ipfs/ path of the blob
+	mounts map[string]string
+
+	// scratch directory uploads are spooled to
+	dir string
+
+	// Concurrent pushes may share a blob, it's removed once no upload, mount or push references it.
+	// maps digest -> references
+	pending map[string]*pendingBlob
+
+	// Sizes the content sources report, kept in memory only as they are not verified against the digest.
+	// maps digest -> size
+	sizes map[string]int64
+
+	flight flightGroup
 
 	registry *registry
 }
@@ -84,19 +106,35 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 	}
 
 	if req.Method == "HEAD" {
-		b.lock.Lock()
-		defer b.lock.Unlock()
+		// with access control, a repo can only read the blobs it references
+		if b.registry.restricted() && !b.references(repo, target) {
+			return b.unknown(resp, req, repo, target)
+		}
 
 		// content is available if image is locally pushed
-		if c, ok := b.contents[target]; ok {
-			resp.Header().Set("Content-Length", fmt.Sprint(len(c)))
+		b.lock.Lock()
+		p, ok := b.contents[target]
+		b.lock.Unlock()
+		if ok {
+			fi, err := os.Stat(p)
+			if err != nil {
+				return &regError{
+					Status:  http.StatusNotFound,
+					Code:    "BLOB_UNKNOWN",
+					Message: err.Error(),
+				}
+			}
+			resp.Header().Set("Content-Length", fmt.Sprint(fi.Size()))
 			resp.Header().Set("Docker-Content-Digest", target)
 			resp.WriteHeader(http.StatusOK)
 			return nil
 		}
 
 		// get it if available on IPFS
-		cid, err := b.registry.resolveCID(repo, target)
+		cid, err := b.locate(repo, target)
+		if err != nil && b.registry.upstream != nil {
+			return b.registry.upstream.blob(resp, req, repo, target)
+		}
 		if err != nil {
 			return &regError{
 				Status:  http.StatusNotFound,
@@ -104,8 +142,7 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 				Message: err.Error(),
 			}
 		}
-		uri := b.registry.ipfsURL([]string{cid, "blobs", target})
-		ipfsResp, err := http.Head(uri)
+		size, err := b.size(cid, target)
 		if err != nil {
 			return &regError{
 				Status:  http.StatusNotFound,
@@ -113,17 +150,93 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 				Message: err.Error(),
 			}
 		}
-		defer ipfsResp.Body.Close()
-		if ipfsResp.StatusCode != http.StatusOK {
+
+		resp.Header().Set("Content-Length", fmt.Sprint(size))
+		resp.Header().Set("Docker-Content-Digest", target)
+		resp.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	// https://github.com/opencontainers/distribution-spec/blob/master/spec.md#get-blob-upload
+	if req.Method == "GET" && service == "uploads" {
+		u, ok := b.session(target)
+		if !ok {
 			return &regError{
 				Status:  http.StatusNotFound,
-				Code:    "BLOB_UNKNOWN",
-				Message: ipfsResp.Status,
+				Code:    "BLOB_UPLOAD_UNKNOWN",
+				Message: "upload unknown",
 			}
 		}
+		u.Lock()
+		defer u.Unlock()
+		resp.Header().Set("Location", "/"+path.Join("v2", path.Join(elem[1:len(elem)-3]...), "blobs/uploads", target))
+		resp.Header().Set("Range", u.rangeHeader())
+		resp.Header().Set("Docker-Upload-UUID", target)
+		resp.WriteHeader(http.StatusNoContent)
+		return nil
+	}
 
-		body, err := ioutil.ReadAll(ipfsResp.Body)
-		size := len(body)
+	// https://github.com/opencontainers/distribution-spec/blob/master/spec.md#cancel-blob-upload
+	if req.Method == "DELETE" && service == "uploads" {
+		u, ok := b.session(target)
+		if !ok {
+			return &regError{
+				Status:  http.StatusNotFound,
+				Code:    "BLOB_UPLOAD_UNKNOWN",
+				Message: "upload unknown",
+			}
+		}
+		u.Lock()
+		defer u.Unlock()
+		// the upload may have been committed or aborted since it was looked up
+		if u.done {
+			return &regError{
+				Status:  http.StatusNotFound,
+				Code:    "BLOB_UPLOAD_UNKNOWN",
+				Message: "upload unknown",
+			}
+		}
+		b.finish(target)
+		u.abort()
+		resp.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if req.Method == "GET" {
+		// with access control, a repo can only read the blobs it references
+		if b.registry.restricted() && !b.references(repo, target) {
+			return b.unknown(resp, req, repo, target)
+		}
+
+		// content is available if image is locally pushed
+		b.lock.Lock()
+		p, ok := b.contents[target]
+		b.lock.Unlock()
+		if ok {
+			if f, err := os.Open(p); err == nil {
+				defer f.Close()
+				resp.Header().Set("Content-Type", "application/octet-stream")
+				resp.Header().Set("Docker-Content-Digest", target)
+				http.ServeContent(resp, req, "", time.Time{}, f)
+				return nil
+			}
+		}
+
+		// blobs are content addressed, the cache is shared by every repo that references them
+		if b.registry.cache != nil {
+			if f, ok := b.registry.cache.open(target); ok {
+				defer f.Close()
+				resp.Header().Set("Content-Type", "application/octet-stream")
+				resp.Header().Set("Docker-Content-Digest", target)
+				http.ServeContent(resp, req, "", time.Time{}, f)
+				return nil
+			}
+		}
+
+		cid, err := b.locate(repo, target)
+		if err != nil && b.registry.upstream != nil {
+			return b.registry.upstream.blob(resp, req, repo, target)
+		}
 		if err != nil {
 			return &regError{
 				Status:  http.StatusNotFound,
@@ -131,87 +244,113 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 				Message: err.Error(),
 			}
 		}
+		bc, rerr := b.registry.openBlob(cid, target, req.Header.Get("Range"))
+		if rerr != nil {
+			return rerr
+		}
+		defer bc.Close()
 
-		resp.Header().Set("Content-Length", fmt.Sprint(size))
+		if bc.length >= 0 {
+			resp.Header().Set("Content-Length", fmt.Sprint(bc.length))
+		}
+		if bc.contentRange != "" {
+			resp.Header().Set("Content-Range", bc.contentRange)
+		}
+		resp.Header().Set("Accept-Ranges", "bytes")
+		resp.Header().Set("Content-Type", "application/octet-stream")
 		resp.Header().Set("Docker-Content-Digest", target)
-		resp.WriteHeader(ipfsResp.StatusCode)
-		io.CopyN(resp, bytes.NewReader(body), int64(size))
-
+		resp.WriteHeader(bc.status)
+		if bc.status == http.StatusPartialContent {
+			// a range can't be verified on its own, the client verifies the digest once the blob is complete
+			io.Copy(resp, bc)
+			return nil
+		}
+		if err := b.registry.copyCached(resp, bc, target); err != nil {
+			b.registry.log.Printf("GET %s from %s: %v", target, cid, err)
+			// the headers are sent, abort the response so the client doesn't take it as complete
+			panic(http.ErrAbortHandler)
+		}
 		return nil
 	}
 
-	if req.Method == "GET" {
-		cid, err := b.registry.resolveCID(repo, target)
+	if req.Method == "POST" && target == "uploads" && digest != "" {
+		id, err := newUUID()
 		if err != nil {
 			return &regError{
-				Status:  http.StatusNotFound,
-				Code:    "BLOB_UNKNOWN",
+				Status:  http.StatusInternalServerError,
+				Code:    "BLOB_UPLOAD_INVALID",
 				Message: err.Error(),
 			}
 		}
-		uri := b.registry.ipfsURL([]string{cid, "blobs", target})
-		ipfsResp, err := netutil.Get(uri)
+		u, err := newUpload(b.dir, id)
 		if err != nil {
 			return &regError{
-				Status:  http.StatusNotFound,
-				Code:    "BLOB_UNKNOWN",
+				Status:  http.StatusInternalServerError,
+				Code:    "BLOB_UPLOAD_INVALID",
 				Message: err.Error(),
 			}
 		}
-		defer ipfsResp.Body.Close()
-		if ipfsResp.StatusCode != http.StatusOK {
+		if _, err := u.write(req.Body); err != nil {
+			u.abort()
 			return &regError{
-				Status:  http.StatusNotFound,
-				Code:    "BLOB_UNKNOWN",
-				Message: ipfsResp.Status,
+				Status:  http.StatusBadRequest,
+				Code:    "BLOB_UPLOAD_INVALID",
+				Message: err.Error(),
 			}
 		}
-
-		// TODO ipfsResp.ContentLength could be -1
-		// copy the whole body content - not desirable
-		body, err := ioutil.ReadAll(ipfsResp.Body)
-		size := len(body)
-		resp.Header().Set("Content-Length", fmt.Sprint(size))
-		resp.Header().Set("Docker-Content-Digest", target)
-		resp.WriteHeader(ipfsResp.StatusCode)
-		io.CopyN(resp, bytes.NewReader(body), int64(size))
-
-		return nil
-	}
-
-	if req.Method == "POST" && target == "uploads" && digest != "" {
-		l := &bytes.Buffer{}
-		io.Copy(l, req.Body)
-		rd := sha256.Sum256(l.Bytes())
-		d := "sha256:" + hex.EncodeToString(rd[:])
+		d := u.digest()
 		if d != digest {
+			u.abort()
 			return &regError{
 				Status:  http.StatusBadRequest,
 				Code:    "DIGEST_INVALID",
 				Message: "digest does not match contents",
 			}
 		}
+		if err := b.add(repo, u, d); err != nil {
+			u.abort()
+			return &regError{
+				Status:  http.StatusInternalServerError,
+				Code:    "BLOB_UPLOAD_INVALID",
+				Message: err.Error(),
+			}
+		}
 
-		b.lock.Lock()
-		defer b.lock.Unlock()
-		b.contents[d] = l.Bytes()
-		digests := b.layers[repo]
-		b.layers[repo] = append(digests, d)
+		b.registry.index.Add(d, &blobInfo{Size: u.size})
 		resp.Header().Set("Docker-Content-Digest", d)
 		resp.WriteHeader(http.StatusCreated)
 		return nil
 	}
 
+	// https://github.com/opencontainers/distribution-spec/blob/master/spec.md#mounting-a-blob-from-another-repository
+	if mount := req.URL.Query().Get("mount"); req.Method == "POST" && target == "uploads" && mount != "" {
+		if b.mount(repo, req.URL.Query().Get("from"), mount) {
+			resp.Header().Set("Location", "/"+path.Join("v2", path.Join(elem[1:len(elem)-2]...), "blobs", mount))
+			resp.Header().Set("Docker-Content-Digest", mount)
+			resp.WriteHeader(http.StatusCreated)
+			return nil
+		}
+		// fall back to a regular upload
+	}
+
 	if req.Method == "POST" && target == "uploads" && digest == "" {
-		id := fmt.Sprint(rand.Int63())
-		resp.Header().Set("Location", "/"+path.Join("v2", path.Join(elem[1:len(elem)-2]...), "blobs/uploads", id))
+		u, err := b.start()
+		if err != nil {
+			return &regError{
+				Status:  http.StatusInternalServerError,
+				Code:    "BLOB_UPLOAD_INVALID",
+				Message: err.Error(),
+			}
+		}
+		resp.Header().Set("Location", "/"+path.Join("v2", path.Join(elem[1:len(elem)-2]...), "blobs/uploads", u.id))
 		resp.Header().Set("Range", "0-0")
+		resp.Header().Set("Docker-Upload-UUID", u.id)
 		resp.WriteHeader(http.StatusAccepted)
 		return nil
 	}
 
 	if req.Method == "PATCH" && service == "uploads" && contentRange != "" {
-		start, end := 0, 0
+		var start, end int64
 		if _, err := fmt.Sscanf(contentRange, "%d-%d", &start, &end); err != nil {
 			return &regError{
 				Status:  http.StatusRequestedRangeNotSatisfiable,
@@ -219,41 +358,79 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 				Message: "We don't understand your Content-Range",
 			}
 		}
-		b.lock.Lock()
-		defer b.lock.Unlock()
-		if start != len(b.uploads[target]) {
+		u, ok := b.session(target)
+		if !ok {
+			return &regError{
+				Status:  http.StatusNotFound,
+				Code:    "BLOB_UPLOAD_UNKNOWN",
+				Message: "upload unknown",
+			}
+		}
+		u.Lock()
+		defer u.Unlock()
+		if u.done {
+			return &regError{
+				Status:  http.StatusNotFound,
+				Code:    "BLOB_UPLOAD_UNKNOWN",
+				Message: "upload unknown",
+			}
+		}
+		if start != u.size {
 			return &regError{
 				Status:  http.StatusRequestedRangeNotSatisfiable,
 				Code:    "BLOB_UPLOAD_UNKNOWN",
 				Message: "Your content range doesn't match what we have",
 			}
 		}
-		l := bytes.NewBuffer(b.uploads[target])
-		io.Copy(l, req.Body)
-		b.uploads[target] = l.Bytes()
+		if _, err := u.write(req.Body); err != nil {
+			return &regError{
+				Status:  http.StatusBadRequest,
+				Code:    "BLOB_UPLOAD_INVALID",
+				Message: err.Error(),
+			}
+		}
 		resp.Header().Set("Location", "/"+path.Join("v2", path.Join(elem[1:len(elem)-3]...), "blobs/uploads", target))
-		resp.Header().Set("Range", fmt.Sprintf("0-%d", len(l.Bytes())-1))
+		resp.Header().Set("Range", u.rangeHeader())
+		resp.Header().Set("Docker-Upload-UUID", target)
 		resp.WriteHeader(http.StatusNoContent)
 		return nil
 	}
 
 	if req.Method == "PATCH" && service == "uploads" && contentRange == "" {
-		b.lock.Lock()
-		defer b.lock.Unlock()
-		if _, ok := b.uploads[target]; ok {
+		u, ok := b.session(target)
+		if !ok {
+			return &regError{
+				Status:  http.StatusNotFound,
+				Code:    "BLOB_UPLOAD_UNKNOWN",
+				Message: "upload unknown",
+			}
+		}
+		u.Lock()
+		defer u.Unlock()
+		if u.done {
+			return &regError{
+				Status:  http.StatusNotFound,
+				Code:    "BLOB_UPLOAD_UNKNOWN",
+				Message: "upload unknown",
+			}
+		}
+		if u.size > 0 {
 			return &regError{
 				Status:  http.StatusBadRequest,
 				Code:    "BLOB_UPLOAD_INVALID",
 				Message: "Stream uploads after first write are not allowed",
 			}
 		}
-
-		l := &bytes.Buffer{}
-		io.Copy(l, req.Body)
-
-		b.uploads[target] = l.Bytes()
+		if _, err := u.write(req.Body); err != nil {
+			return &regError{
+				Status:  http.StatusBadRequest,
+				Code:    "BLOB_UPLOAD_INVALID",
+				Message: err.Error(),
+			}
+		}
 		resp.Header().Set("Location", "/"+path.Join("v2", path.Join(elem[1:len(elem)-3]...), "blobs/uploads", target))
-		resp.Header().Set("Range", fmt.Sprintf("0-%d", len(l.Bytes())-1))
+		resp.Header().Set("Range", u.rangeHeader())
+		resp.Header().Set("Docker-Upload-UUID", target)
 		resp.WriteHeader(http.StatusNoContent)
 		return nil
 	}
@@ -267,24 +444,54 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 	}
 
 	if req.Method == "PUT" && service == "uploads" && digest != "" {
-		b.lock.Lock()
-		defer b.lock.Unlock()
-		l := bytes.NewBuffer(b.uploads[target])
-		io.Copy(l, req.Body)
-		rd := sha256.Sum256(l.Bytes())
-		d := "sha256:" + hex.EncodeToString(rd[:])
+		u, ok := b.session(target)
+		if !ok {
+			return &regError{
+				Status:  http.StatusNotFound,
+				Code:    "BLOB_UPLOAD_UNKNOWN",
+				Message: "upload unknown",
+			}
+		}
+		u.Lock()
+		defer u.Unlock()
+		if u.done {
+			return &regError{
+				Status:  http.StatusNotFound,
+				Code:    "BLOB_UPLOAD_UNKNOWN",
+				Message: "upload unknown",
+			}
+		}
+
+		// the session is finished whatever the outcome
+		b.finish(target)
+
+		if _, err := u.write(req.Body); err != nil {
+			u.abort()
+			return &regError{
+				Status:  http.StatusBadRequest,
+				Code:    "BLOB_UPLOAD_INVALID",
+				Message: err.Error(),
+			}
+		}
+		d := u.digest()
 		if d != digest {
+			u.abort()
 			return &regError{
 				Status:  http.StatusBadRequest,
 				Code:    "DIGEST_INVALID",
 				Message: "digest does not match contents",
 			}
 		}
+		if err := b.add(repo, u, d); err != nil {
+			u.abort()
+			return &regError{
+				Status:  http.StatusInternalServerError,
+				Code:    "BLOB_UPLOAD_INVALID",
+				Message: err.Error(),
+			}
+		}
 
-		b.contents[d] = l.Bytes()
-		digests := b.layers[repo]
-		b.layers[repo] = append(digests, d)
-		delete(b.uploads, target)
+		b.registry.index.Add(d, &blobInfo{Size: u.size})
 		resp.Header().Set("Docker-Content-Digest", d)
 		resp.WriteHeader(http.StatusCreated)
 		return nil
@@ -297,39 +504,355 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 	}
 }
 
-func (b *blobs) get(repo string) (map[string][]byte, bool) {
+// size returns the size of the blob from metadata only, the content is never downloaded.
+// The blob index is consulted first, then the gateway and finally the IPFS API.
+func (b *blobs) size(cid, digest string) (int64, error) {
+	if info, ok := b.registry.index.Get(digest); ok {
+		return info.Size, nil
+	}
 	b.lock.Lock()
+	size, ok := b.sizes[digest]
+	b.lock.Unlock()
+	if ok {
+		return size, nil
+	}
+	// concurrent requests for a blob that is not indexed yet share one lookup
+	v, err := b.flight.do(path.Join(cid, digest), func() (interface{}, error) {
+		return b.stat(cid, digest)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
+}
 
-	digests, ok := b.layers[repo]
-	if !ok {
-		return nil, false
+// stat looks up the size of the blob from the content sources.
+// The size is only indexed once the content is read and verified.
+func (b *blobs) stat(cid, digest string) (int64, error) {
+	p := path.Join(cid, "blobs", digest)
+	var size int64 = -1
+	var lastErr error
+	for _, src := range b.registry.contentSources() {
+		switch {
+		case src == ContentAPI:
+			st, err := b.registry.ipfsClient.Stat(p)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			size = int64(st.Size)
+		case b.registry.trustless != nil:
+			n, err := b.registry.trustless.size(cid, []string{"blobs", digest})
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			size = n
+		default:
+			ipfsResp, err := b.registry.gateways.Do("HEAD", p, nil)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			ipfsResp.Body.Close()
+			if ipfsResp.StatusCode != http.StatusOK || ipfsResp.ContentLength < 0 {
+				lastErr = fmt.Errorf("cid: %s %s", cid, ipfsResp.Status)
+				continue
+			}
+			size = ipfsResp.ContentLength
+		}
+		break
+	}
+	if size < 0 {
+		return 0, lastErr
 	}
 
-	layers := make(map[string][]byte)
-	for _, d := range digests {
-		blob, ok := b.contents[d]
-		if !ok {
-			return nil, false
+	b.lock.Lock()
+	b.sizes[digest] = size
+	b.lock.Unlock()
+	return size, nil
+}
+
+// copyCached copies the blob to w and verifies its digest, populating the cache while the blob streams.
+// The verified size is indexed.
+func (r *registry) copyCached(w io.Writer, rc io.Reader, digest string) error {
+	var cw *cacheWriter
+	if r.cache != nil {
+		var err error
+		if cw, err = r.cache.writer(digest); err == nil {
+			w = io.MultiWriter(w, cw)
+		}
+	}
+	n, err := copyVerified(w, rc, digest)
+	if err != nil {
+		if cw != nil {
+			cw.abort()
+		}
+		return err
+	}
+	r.index.Add(digest, &blobInfo{Size: n})
+	if cw != nil {
+		if err := cw.commit(); err != nil {
+			r.log.Printf("cache %s: %v", digest, err)
 		}
-		layers[d] = blob
 	}
+	return nil
+}
 
+// start registers a new upload session
+func (b *blobs) start() (*upload, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	u, err := newUpload(b.dir, id)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	b.uploads[id] = u
+	b.lock.Unlock()
+	return u, nil
+}
+
+// session returns the upload session for id
+func (b *blobs) session(id string) (*upload, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	u, ok := b.uploads[id]
+	return u, ok
+}
+
+// finish unregisters the upload session
+func (b *blobs) finish(id string) {
+	b.lock.Lock()
+	delete(b.uploads, id)
 	b.lock.Unlock()
-	return layers, true
 }
 
-func (b *blobs) remove(repo string) {
+// expire aborts the upload sessions that have been idle for longer than ttl
+// and removes the blobs that no manifest push consumed within ttl
+func (b *blobs) expire(ttl time.Duration) {
+	var expired []*upload
 	b.lock.Lock()
+	for id, u := range b.uploads {
+		if u.idle() > ttl {
+			expired = append(expired, u)
+			delete(b.uploads, id)
+		}
+	}
+	for d, p := range b.pending {
+		if p.pins == 0 && time.Since(p.last) > ttl {
+			b.drop(d)
+			b.registry.log.Printf("blob %s expired", d)
+		}
+	}
+	b.lock.Unlock()
 
-	digests, ok := b.layers[repo]
+	for _, u := range expired {
+		u.Lock()
+		u.abort()
+		u.Unlock()
+		b.registry.log.Printf("upload %s expired", u.id)
+	}
+}
+
+// path returns the local path of a pushed blob or the /ipfs/ path of a mounted blob.
+// Callers must hold the lock.
+func (b *blobs) path(digest string) (string, bool) {
+	if p, ok := b.contents[digest]; ok {
+		return p, true
+	}
+	p, ok := b.mounts[digest]
+	return p, ok
+}
+
+// mount makes the blob known to repo without uploading it again, either because it was
+// pushed in another session or because the from repo references a CID that holds it,
+// which is found through the blob index after a restart.
+func (b *blobs) mount(repo, from, digest string) bool {
+	if !isDigest(digest) || !b.references(from, digest) {
+		return false
+	}
+	// outside the lock, the resolvers may be asked
+	cid, held := b.holder(from, digest)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.path(digest); !ok {
+		if !held {
+			return false
+		}
+		b.mounts[digest] = "/" + path.Join("ipfs", cid, "blobs", digest)
+		// blob requests for repo resolve to the CID holding the blob
+		b.registry.cids.Add(repo, digest, cid)
+	}
+	b.hold(repo, digest)
+	return true
+}
+
+// locate returns the CID of an image directory holding the blob: the one repo references it through,
+// else the most recent one the blob index knows, else the one the resolvers know
+func (b *blobs) locate(repo, digest string) (string, error) {
+	if cid, ok := b.registry.local(repo, digest); ok {
+		return cid, nil
+	}
+	if info, ok := b.registry.index.Get(digest); ok && len(info.CIDs) > 0 {
+		return info.CIDs[0], nil
+	}
+	return b.registry.resolveCID(repo, digest)
+}
+
+// references returns whether repo references the blob: it was pushed or mounted to repo,
+// or repo or one of its tags resolves it to a CID holding it.
+// Blobs are stored once for every repo, this keeps the blobs of a repo from being read through another.
+func (b *blobs) references(repo, digest string) bool {
+	b.lock.Lock()
+	p, ok := b.pending[digest]
+	pushed := ok && p.repos[repo]
+	b.lock.Unlock()
+	if pushed {
+		return true
+	}
+	if _, ok := b.holder(repo, digest); ok {
+		return true
+	}
+	// the repo is the CID
+	if cid, ok := cidRepo(repo); ok {
+		if info, ok := b.registry.index.Get(digest); ok {
+			for _, c := range info.CIDs {
+				if c == cid {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// unknown answers the request for a blob repo doesn't reference, from upstream if there is one
+func (b *blobs) unknown(resp http.ResponseWriter, req *http.Request, repo, digest string) *regError {
+	if b.registry.upstream != nil {
+		return b.registry.upstream.blob(resp, req, repo, digest)
+	}
+	return &regError{
+		Status:  http.StatusNotFound,
+		Code:    "BLOB_UNKNOWN",
+		Message: fmt.Sprintf("blob %s of %q not found", digest, repo),
+	}
+}
+
+// holder returns the CID of an image directory holding the blob that repo references,
+// either directly or through one of its tags, pushed or known to the resolvers
+func (b *blobs) holder(repo, digest string) (string, bool) {
+	if cid, ok := b.registry.cids.Get(repo, digest); ok {
+		return cid, true
+	}
+	info, ok := b.registry.index.Get(digest)
 	if !ok {
-		return
+		return "", false
 	}
-	delete(b.layers, repo)
+	holds := func(cid string) bool {
+		for _, c := range info.CIDs {
+			if c == cid {
+				return true
+			}
+		}
+		return false
+	}
+	for _, tag := range b.registry.cids.Tags(repo) {
+		if cid, ok := b.registry.cids.Get(repo, tag); ok && holds(cid) {
+			return cid, true
+		}
+	}
+	for _, tag := range b.registry.resolver.Resolve(repo, "") {
+		if cid, err := b.registry.resolveCID(repo, tag); err == nil && holds(cid) {
+			return cid, true
+		}
+	}
+	return "", false
+}
+
+// collect returns the paths of the blobs with the given digests keyed by digest
+// along with the digests that are not available. The blobs are pinned until released.
+func (b *blobs) collect(digests []string) (map[string]string, []string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	layers := make(map[string]string)
+	var missing []string
+	for _, d := range uniq(digests) {
+		if p, ok := b.path(d); ok {
+			layers[d] = p
+			if pb, ok := b.pending[d]; ok {
+				pb.pins++
+			}
+		} else {
+			missing = append(missing, d)
+		}
+	}
+	return layers, missing
+}
+
+// add moves the completed upload to the scratch directory and holds the blob until a manifest push consumes it
+func (b *blobs) add(repo string, u *upload, digest string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// under the lock so that a release of the same blob can't remove the file behind it
+	p, err := u.commit(b.dir, digest)
+	if err != nil {
+		return err
+	}
+	b.contents[digest] = p
+	b.hold(repo, digest)
+	return nil
+}
+
+// hold adds a pending reference of repo to the blob.
+// Callers must hold the lock.
+func (b *blobs) hold(repo, digest string) {
+	p, ok := b.pending[digest]
+	if !ok {
+		p = &pendingBlob{repos: map[string]bool{}}
+		b.pending[digest] = p
+	}
+	p.refs++
+	p.repos[repo] = true
+	p.last = time.Now()
+}
+
+// release unpins the collected blobs. A push that added them to IPFS consumes a reference of each,
+// blobs are removed from the scratch directory once nothing references them.
+func (b *blobs) release(digests []string, pushed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 
 	for _, d := range digests {
-		delete(b.contents, d)
+		p, ok := b.pending[d]
+		if !ok {
+			continue
+		}
+		p.pins--
+		if pushed && p.refs > 0 {
+			p.refs--
+		}
+		if p.refs <= 0 && p.pins <= 0 {
+			b.drop(d)
+		}
 	}
+}
 
-	b.lock.Unlock()
+// drop removes the blob from the scratch directory.
+// Callers must hold the lock.
+func (b *blobs) drop(digest string) {
+	if p, ok := b.contents[digest]; ok {
+		os.Remove(p)
+	}
+	delete(b.contents, digest)
+	delete(b.mounts, digest)
+	delete(b.pending, digest)
 }
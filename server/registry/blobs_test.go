@@ -0,0 +1,676 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miguelmota/ipdr/server/registry/image"
+)
+
+func TestChunkedUpload(t *testing.T) {
+	r, srv, done := newTestRegistry(t, nil)
+	defer done()
+
+	resp, err := http.Post(srv.URL+"/v2/foo/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected %d; got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	location := srv.URL + resp.Header.Get("Location")
+
+	chunks := [][]byte{[]byte("hello "), []byte("ipdr")}
+	var offset int
+	for _, c := range chunks {
+		req, _ := http.NewRequest("PATCH", location, bytes.NewReader(c))
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+len(c)-1))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected %d; got %d", http.StatusNoContent, resp.StatusCode)
+		}
+		offset += len(c)
+		if expected := fmt.Sprintf("0-%d", offset-1); resp.Header.Get("Range") != expected {
+			t.Fatalf("expected range %s; got %s", expected, resp.Header.Get("Range"))
+		}
+	}
+
+	digest := computeDigest([]byte("hello ipdr"))
+	req, _ := http.NewRequest("PUT", location+"?digest="+digest, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d; got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	layers, missing := r.blobs.collect([]string{digest})
+	if len(missing) != 0 {
+		t.Fatal("expected the blob to be pending")
+	}
+	b, err := ioutil.ReadFile(layers[digest])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello ipdr" {
+		t.Fatalf("expected spooled blob content; got %q", b)
+	}
+	if len(r.blobs.uploads) != 0 {
+		t.Fatalf("expected upload session to be finished; got %d", len(r.blobs.uploads))
+	}
+}
+
+func TestMonolithicUploadDigestMismatch(t *testing.T) {
+	r, srv, done := newTestRegistry(t, nil)
+	defer done()
+
+	digest := computeDigest([]byte("something else"))
+	resp, err := http.Post(srv.URL+"/v2/foo/blobs/uploads/?digest="+digest, "", bytes.NewReader([]byte("hello ipdr")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d; got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	files, _ := ioutil.ReadDir(filepath.Join(r.blobs.dir, "uploads"))
+	if len(files) != 0 {
+		t.Fatalf("expected spooled data to be discarded; got %d files", len(files))
+	}
+}
+
+func TestBlobGetRange(t *testing.T) {
+	content := []byte("0123456789")
+	digest := computeDigest(content)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/ipfs/bafytest/blobs/"+digest {
+			http.NotFound(w, req)
+			return
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer gw.Close()
+
+	r, srv, done := newTestRegistry(t, &Config{IPFSGateway: gw.URL})
+	defer done()
+	r.cids.Add("foo", digest, "bafytest")
+
+	req, _ := http.NewRequest("GET", srv.URL+"/v2/foo/blobs/"+digest, nil)
+	req.Header.Set("Range", "bytes=4-")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected %d; got %d", http.StatusPartialContent, resp.StatusCode)
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != "bytes 4-9/10" {
+		t.Fatalf("expected content range bytes 4-9/10; got %s", cr)
+	}
+	if resp.ContentLength != 6 {
+		t.Fatalf("expected content length 6; got %d", resp.ContentLength)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != "456789" {
+		t.Fatalf("expected 456789; got %s", b)
+	}
+}
+
+func TestBlobGetVerified(t *testing.T) {
+	content := []byte("0123456789")
+	digest := computeDigest(content)
+	served := content
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(served))
+	}))
+	defer gw.Close()
+
+	r, srv, done := newTestRegistry(t, &Config{IPFSGateway: gw.URL})
+	defer done()
+	r.cids.Add("foo", digest, "bafytest")
+
+	get := func() ([]byte, error) {
+		resp, err := http.Get(srv.URL + "/v2/foo/blobs/" + digest)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	if b, err := get(); err != nil || string(b) != string(content) {
+		t.Fatalf("expected %s; got %s, %v", content, b, err)
+	}
+
+	// substituted content of the same size
+	served = []byte("9876543210")
+	if b, err := get(); err == nil {
+		t.Fatalf("expected the response to be aborted; got %s", b)
+	}
+
+	// substituted content of another size is rejected before it's sent
+	served = []byte("nope")
+	r.index.Add(digest, &blobInfo{Size: int64(len(content))})
+	if _, err := get(); err == nil || err.Error() != "status 502" {
+		t.Fatalf("expected status 502; got %v", err)
+	}
+}
+
+func TestBlobGetAPI(t *testing.T) {
+	node := newFakeNode()
+	defer node.Close()
+	content := []byte("0123456789")
+	digest := computeDigest(content)
+	node.files["bafytest/blobs/"+digest] = content
+	node.files["bafytest/manifests/latest"] = []byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","layers":[]}`)
+
+	// no gateway is listening, content is read through the API either way
+	for _, source := range []string{ContentAPI, ContentGateway} {
+		r, srv, done := newTestRegistry(t, &Config{IPFSHost: node.host(), IPFSGateway: "http://127.0.0.1:1", ContentSource: source})
+		defer done()
+		r.cids.Add("foo", digest, "bafytest")
+
+		resp, err := http.Get(srv.URL + "/v2/foo/blobs/" + digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(b) != string(content) {
+			t.Fatalf("%s: expected %s; got %d %s", source, content, resp.StatusCode, b)
+		}
+
+		req, _ := http.NewRequest("GET", srv.URL+"/v2/foo/blobs/"+digest, nil)
+		req.Header.Set("Range", "bytes=4-6")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent || string(b) != "456" {
+			t.Fatalf("%s: expected 456; got %d %s", source, resp.StatusCode, b)
+		}
+		if cr := resp.Header.Get("Content-Range"); cr != "bytes 4-6/10" {
+			t.Fatalf("%s: expected content range bytes 4-6/10; got %s", source, cr)
+		}
+
+		req.Header.Set("Range", "bytes=20-")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("%s: expected %d; got %d", source, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+		}
+
+		if _, err := r.manifests.getManifest("bafytest", "latest"); err != nil {
+			t.Fatalf("%s: %v", source, err)
+		}
+	}
+}
+
+func TestBlobHeadFromMetadata(t *testing.T) {
+	content := []byte("0123456789")
+	digest := computeDigest(content)
+	var heads, gets int
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "HEAD":
+			heads++
+		case "GET":
+			gets++
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer gw.Close()
+
+	r, srv, done := newTestRegistry(t, &Config{IPFSGateway: gw.URL})
+	defer done()
+	r.cids.Add("foo", digest, "bafytest")
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("HEAD", srv.URL+"/v2/foo/blobs/"+digest, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected %d; got %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp.ContentLength != int64(len(content)) {
+			t.Fatalf("expected content length %d; got %d", len(content), resp.ContentLength)
+		}
+	}
+
+	if gets != 0 {
+		t.Fatalf("expected no GET against the gateway; got %d", gets)
+	}
+	if heads != 1 {
+		t.Fatalf("expected a single HEAD against the gateway; got %d", heads)
+	}
+	// the size the gateway reports is persisted only once the content is verified
+	if info, ok := newBlobIndex(r.config.BlobIndexPath).Get(digest); ok {
+		t.Fatalf("expected no persisted size before the content is read; got %v", info)
+	}
+	resp, err := http.Get(srv.URL + "/v2/foo/blobs/" + digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if info, ok := newBlobIndex(r.config.BlobIndexPath).Get(digest); !ok || info.Size != int64(len(content)) {
+		t.Fatalf("expected persisted size %d; got %v", len(content), info)
+	}
+}
+
+func TestBlobHeadUnverifiedSize(t *testing.T) {
+	content := []byte("0123456789")
+	digest := computeDigest(content)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// reports the size of other content
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader([]byte("lie")))
+	}))
+	defer gw.Close()
+
+	r, srv, done := newTestRegistry(t, &Config{IPFSGateway: gw.URL})
+	defer done()
+	r.cids.Add("foo", digest, "bafytest")
+
+	req, _ := http.NewRequest("HEAD", srv.URL+"/v2/foo/blobs/"+digest, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// aborted on the digest mismatch
+	if resp, err := http.Get(srv.URL + "/v2/foo/blobs/" + digest); err == nil {
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if info, ok := newBlobIndex(r.config.BlobIndexPath).Get(digest); ok {
+		t.Fatalf("expected the unverified size not to be persisted; got %+v", info)
+	}
+}
+
+func TestBlobResolvedRepo(t *testing.T) {
+	content := []byte("0123456789")
+	digest := computeDigest(content)
+	dir, err := ioutil.TempDir("", "ipdr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "app"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(dir, "app", "v1"), []byte("bafyresolved"), 0644)
+
+	r, srv, done := newTestRegistry(t, &Config{CIDResolvers: []string{"file:" + dir}})
+	defer done()
+	r.index.Add(digest, &blobInfo{Size: int64(len(content)), CIDs: []string{"bafyresolved"}})
+
+	req, _ := http.NewRequest("HEAD", srv.URL+"/v2/app/blobs/"+digest, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d for a blob of a resolved repo; got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// repos resolved to the CID holding the blob reference it, other repos don't
+	if !r.blobs.references("app", digest) {
+		t.Fatal("expected the resolved repo to reference the blob")
+	}
+	if r.blobs.references("other", digest) {
+		t.Fatal("expected another repo not to reference the blob")
+	}
+}
+
+func TestCrossRepoMount(t *testing.T) {
+	node := newFakeNode()
+	defer node.Close()
+
+	r, srv, done := newTestRegistry(t, &Config{IPFSHost: node.host()})
+	defer done()
+
+	config := push(t, srv, "base", []byte(`{"os":"linux"}`))
+	layer := push(t, srv, "base", []byte("base layer"))
+	mf, _ := json.Marshal(&image.Manifest{
+		SchemaVersion: 2,
+		MediaType:     image.ManifestType,
+		Config:        &image.Config{MediaType: image.ConfigType, Digest: config},
+		Layers:        []*image.Layer{{MediaType: image.LayerType, Digest: layer}},
+	})
+	resp := putManifest(t, srv, "base", "latest", image.ManifestType, mf)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d; got %d", http.StatusCreated, resp.StatusCode)
+	}
+	base := resp.Header.Get("X-Docker-Content-ID")
+
+	// the base layer is only in IPFS now
+	if _, ok := r.blobs.contents[layer]; ok {
+		t.Fatal("expected pushed blobs to be released")
+	}
+
+	for _, d := range []string{config, layer} {
+		resp, err := http.Post(srv.URL+"/v2/app/blobs/uploads/?mount="+d+"&from=base", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected %d; got %d", http.StatusCreated, resp.StatusCode)
+		}
+		if loc := resp.Header.Get("Location"); loc != "/v2/app/blobs/"+d {
+			t.Fatalf("unexpected location %s", loc)
+		}
+	}
+
+	// unknown blobs start a regular upload
+	resp, err := http.Post(srv.URL+"/v2/app/blobs/uploads/?mount="+computeDigest([]byte("nope"))+"&from=base", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected %d; got %d", http.StatusAccepted, resp.StatusCode)
+	}
+
+	resp = putManifest(t, srv, "app", "v1", image.ManifestType, mf)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d; got %d", http.StatusCreated, resp.StatusCode)
+	}
+	cid := resp.Header.Get("X-Docker-Content-ID")
+	b := node.files[cid+"/blobs/"+layer]
+	if string(b) != "base layer" {
+		t.Fatalf("expected the base layer to be linked into %s; got %q", cid, b)
+	}
+	if len(node.pinned) != 1 || node.pinned[0] != cid {
+		t.Fatalf("expected %s to be pinned; got %v", cid, node.pinned)
+	}
+	if cid == base {
+		t.Fatal("expected a new CID for app:v1")
+	}
+}
+
+func TestBlobIndexAfterRestart(t *testing.T) {
+	node := newFakeNode()
+	defer node.Close()
+
+	r, srv, done := newTestRegistry(t, &Config{IPFSHost: node.host()})
+	defer done()
+
+	config := push(t, srv, "base", []byte(`{"os":"linux"}`))
+	layer := push(t, srv, "base", []byte("base layer"))
+	mf, _ := json.Marshal(&image.Manifest{
+		SchemaVersion: 2,
+		MediaType:     image.ManifestType,
+		Config:        &image.Config{MediaType: image.ConfigType, Size: 14, Digest: config},
+		Layers:        []*image.Layer{{MediaType: image.LayerType, Size: 10, Digest: layer}},
+	})
+	resp := putManifest(t, srv, "base", "latest", image.ManifestType, mf)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d; got %d", http.StatusCreated, resp.StatusCode)
+	}
+	cid := resp.Header.Get("X-Docker-Content-ID")
+
+	// only the tags and the blob index are left after a restart
+	restarted := newRegistry(r.config, Logger(log.New(ioutil.Discard, "", log.LstdFlags)))
+	defer restarted.Close()
+	srv2 := httptest.NewServer(http.HandlerFunc(restarted.root))
+	defer srv2.Close()
+
+	info, ok := restarted.index.Get(layer)
+	if !ok || info.Size != 10 || info.MediaType != image.LayerType || !reflect.DeepEqual(info.CIDs, []string{cid}) {
+		t.Fatalf("unexpected index entry %+v", info)
+	}
+	if info, ok := restarted.index.Get(computeDigest(mf)); !ok || info.MediaType != image.ManifestType {
+		t.Fatalf("unexpected index entry %+v", info)
+	}
+
+	req, _ := http.NewRequest("HEAD", srv2.URL+"/v2/base/blobs/"+layer, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 10 {
+		t.Fatalf("expected 200 with content length 10; got %d %d", resp.StatusCode, resp.ContentLength)
+	}
+
+	// mounting needs the from repo to reference a CID holding the blob
+	for _, m := range []struct {
+		from   string
+		status int
+	}{
+		{"other", http.StatusAccepted},
+		{"base", http.StatusCreated},
+	} {
+		resp, err := http.Post(srv2.URL+"/v2/app/blobs/uploads/?mount="+layer+"&from="+m.from, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != m.status {
+			t.Fatalf("expected %d mounting from %s; got %d", m.status, m.from, resp.StatusCode)
+		}
+	}
+}
+
+func TestConcurrentPushes(t *testing.T) {
+	node := newFakeNode()
+	defer node.Close()
+
+	r, srv, done := newTestRegistry(t, &Config{IPFSHost: node.host()})
+	defer done()
+
+	// both pushes upload the shared layer before either manifest is pushed
+	shared := computeDigest([]byte("shared layer"))
+	manifests := make(map[string][]byte)
+	expected := make(map[string][]string)
+	for _, tag := range []string{"pr-1", "pr-2"} {
+		push(t, srv, "app", []byte("shared layer"))
+		config := push(t, srv, "app", []byte(`{"tag":"`+tag+`"}`))
+		layer := push(t, srv, "app", []byte("layer "+tag))
+		mf, _ := json.Marshal(&image.Manifest{
+			SchemaVersion: 2,
+			MediaType:     image.OCIManifestType,
+			Config:        &image.Config{MediaType: image.OCIConfigType, Digest: config},
+			Layers: []*image.Layer{
+				{MediaType: image.OCILayerGzipType, Digest: shared},
+				{MediaType: image.OCILayerGzipType, Digest: layer},
+			},
+		})
+		manifests[tag] = mf
+		expected[tag] = []string{"blobs/" + config, "blobs/" + layer, "blobs/" + shared}
+	}
+
+	for _, tag := range []string{"pr-1", "pr-2"} {
+		resp := putManifest(t, srv, "app", tag, image.OCIManifestType, manifests[tag])
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("%s: expected %d; got %d", tag, http.StatusCreated, resp.StatusCode)
+		}
+		cid := resp.Header.Get("X-Docker-Content-ID")
+		var blobs []string
+		for _, p := range node.paths(cid) {
+			if strings.HasPrefix(p, "blobs/") {
+				blobs = append(blobs, p)
+			}
+		}
+		sort.Strings(expected[tag])
+		if !reflect.DeepEqual(blobs, expected[tag]) {
+			t.Fatalf("%s: expected %v; got %v", tag, expected[tag], blobs)
+		}
+	}
+
+	// the shared layer is kept for pr-2 after pr-1 is pushed, and released once both are
+	r.blobs.lock.Lock()
+	n := len(r.blobs.contents)
+	r.blobs.lock.Unlock()
+	if n != 0 {
+		t.Fatalf("expected every blob to be released; got %d", n)
+	}
+}
+
+func TestUploadStatusAndCancel(t *testing.T) {
+	r, srv, done := newTestRegistry(t, nil)
+	defer done()
+
+	resp, err := http.Post(srv.URL+"/v2/foo/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	id := resp.Header.Get("Docker-Upload-UUID")
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Fatalf("expected a UUID upload id; got %q", id)
+	}
+	location := srv.URL + resp.Header.Get("Location")
+
+	req, _ := http.NewRequest("PATCH", location, bytes.NewReader([]byte("hello")))
+	req.Header.Set("Content-Range", "0-4")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected %d; got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if rng := resp.Header.Get("Range"); rng != "0-4" {
+		t.Fatalf("expected range 0-4; got %s", rng)
+	}
+
+	req, _ = http.NewRequest("DELETE", location, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected %d; got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(r.blobs.dir, "uploads"))
+	if len(files) != 0 {
+		t.Fatalf("expected spooled data to be discarded; got %d files", len(files))
+	}
+
+	for _, method := range []string{"GET", "PATCH", "PUT", "DELETE"} {
+		req, _ := http.NewRequest(method, location+"?digest="+computeDigest([]byte("hello")), nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: expected %d; got %d", method, http.StatusNotFound, resp.StatusCode)
+		}
+	}
+}
+
+func TestUploadDeleteCommitted(t *testing.T) {
+	r, srv, done := newTestRegistry(t, nil)
+	defer done()
+
+	resp, err := http.Post(srv.URL+"/v2/foo/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	id := resp.Header.Get("Docker-Upload-UUID")
+	location := srv.URL + resp.Header.Get("Location")
+
+	// the upload is committed while the DELETE waits for it
+	u, _ := r.blobs.session(id)
+	u.Lock()
+	deleted := make(chan int)
+	go func() {
+		req, _ := http.NewRequest("DELETE", location, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			deleted <- 0
+			return
+		}
+		resp.Body.Close()
+		deleted <- resp.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond)
+	u.write(bytes.NewReader([]byte("hello")))
+	r.blobs.finish(id)
+	if err := r.blobs.add("foo", u, u.digest()); err != nil {
+		t.Fatal(err)
+	}
+	u.Unlock()
+
+	if status := <-deleted; status != http.StatusNotFound {
+		t.Fatalf("expected %d; got %d", http.StatusNotFound, status)
+	}
+	if _, err := os.Stat(r.blobs.contents[computeDigest([]byte("hello"))]); err != nil {
+		t.Fatalf("expected the committed blob to be kept: %v", err)
+	}
+}
+
+func TestUploadExpiry(t *testing.T) {
+	r, srv, done := newTestRegistry(t, nil)
+	defer done()
+
+	resp, err := http.Post(srv.URL+"/v2/foo/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := srv.URL + resp.Header.Get("Location")
+
+	r.blobs.expire(time.Hour)
+	if len(r.blobs.uploads) != 1 {
+		t.Fatalf("expected the session to be kept; got %d", len(r.blobs.uploads))
+	}
+	r.blobs.expire(0)
+	if len(r.blobs.uploads) != 0 {
+		t.Fatalf("expected the session to expire; got %d", len(r.blobs.uploads))
+	}
+
+	resp, err = http.Get(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d; got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
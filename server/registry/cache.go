@@ -0,0 +1,259 @@
+package registry
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCache is a content addressed cache of blobs and manifests keyed by digest.
+// The least recently used entries are evicted once the size budget is exceeded.
+// Entries are files under dir/sha256 whose modification time records their last use,
+// so the cache and its order survive restarts.
+type diskCache struct {
+	dir    string
+	budget int64
+
+	// front is the most recently used
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+
+	hits      int64
+	misses    int64
+	evictions int64
+
+	lock sync.Mutex
+}
+
+type cacheEntry struct {
+	digest string
+	size   int64
+}
+
+// CacheStats are the counters of the disk cache
+type CacheStats struct {
+	Size      int64 `json:"size"`
+	Budget    int64 `json:"budget"`
+	Entries   int   `json:"entries"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// newDiskCache loads the cache in dir and evicts entries above the budget
+func newDiskCache(dir string, budget int64) (*diskCache, error) {
+	c := &diskCache{
+		dir:     dir,
+		budget:  budget,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+	// leftovers of interrupted writes
+	os.RemoveAll(filepath.Join(dir, "tmp"))
+	for _, d := range []string{"tmp", "sha256"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "sha256"))
+	if err != nil {
+		return nil, err
+	}
+	// oldest first so that the most recently used ends up in front
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		digest := "sha256:" + f.Name()
+		c.entries[digest] = c.lru.PushFront(&cacheEntry{digest: digest, size: f.Size()})
+		c.size += f.Size()
+	}
+
+	c.lock.Lock()
+	c.evict()
+	c.lock.Unlock()
+	return c, nil
+}
+
+func (c *diskCache) path(digest string) string {
+	return filepath.Join(c.dir, "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// open returns the cached content of the digest. Callers need to close the file.
+func (c *diskCache) open(digest string) (*os.File, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[digest]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	f, err := os.Open(c.path(digest))
+	if err != nil {
+		c.remove(e)
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	now := time.Now()
+	os.Chtimes(f.Name(), now, now)
+	return f, true
+}
+
+// get returns the cached content of the digest
+func (c *diskCache) get(digest string) ([]byte, bool) {
+	f, ok := c.open(digest)
+	if !ok {
+		return nil, false
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	return b, err == nil
+}
+
+// add caches the content, which must match the digest
+func (c *diskCache) add(digest string, b []byte) error {
+	w, err := c.writer(digest)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		w.abort()
+		return err
+	}
+	return w.commit()
+}
+
+// writer returns a writer that caches the content once it's complete and matches the digest
+func (c *diskCache) writer(digest string) (*cacheWriter, error) {
+	if !isDigest(digest) || !strings.HasPrefix(digest, "sha256:") {
+		return nil, fmt.Errorf("unsupported digest: %s", digest)
+	}
+	f, err := ioutil.TempFile(filepath.Join(c.dir, "tmp"), "cache")
+	if err != nil {
+		return nil, err
+	}
+	return &cacheWriter{
+		cache:  c,
+		digest: digest,
+		file:   f,
+		hash:   sha256.New(),
+	}, nil
+}
+
+// Stats returns the counters of the cache
+func (c *diskCache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return CacheStats{
+		Size:      c.size,
+		Budget:    c.budget,
+		Entries:   len(c.entries),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// insert records the file written to tmp as the content of the digest
+func (c *diskCache) insert(digest, tmp string, size int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.entries[digest]; ok {
+		c.lru.MoveToFront(e)
+		return os.Remove(tmp)
+	}
+	if size > c.budget {
+		return os.Remove(tmp)
+	}
+	if err := os.Rename(tmp, c.path(digest)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	c.entries[digest] = c.lru.PushFront(&cacheEntry{digest: digest, size: size})
+	c.size += size
+	c.evict()
+	return nil
+}
+
+// evict removes the least recently used entries until the cache fits the budget
+func (c *diskCache) evict() {
+	for c.size > c.budget {
+		e := c.lru.Back()
+		if e == nil {
+			return
+		}
+		c.remove(e)
+		c.evictions++
+	}
+}
+
+func (c *diskCache) remove(e *list.Element) {
+	entry := e.Value.(*cacheEntry)
+	os.Remove(c.path(entry.digest))
+	c.lru.Remove(e)
+	delete(c.entries, entry.digest)
+	c.size -= entry.size
+}
+
+// cacheWriter spools content to the cache
+type cacheWriter struct {
+	cache  *diskCache
+	digest string
+	file   *os.File
+	hash   hash.Hash
+	size   int64
+	err    error
+}
+
+// Write never fails so that a cache failure doesn't interrupt the stream it's populated from,
+// the failure is reported by commit instead
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		if _, w.err = w.file.Write(p); w.err == nil {
+			w.hash.Write(p)
+			w.size += int64(len(p))
+		}
+	}
+	return len(p), nil
+}
+
+// commit adds the content to the cache if it matches the digest
+func (w *cacheWriter) commit() error {
+	if err := w.file.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.err == nil {
+		if d := "sha256:" + hex.EncodeToString(w.hash.Sum(nil)); d != w.digest {
+			w.err = fmt.Errorf("digest mismatch: %s != %s", d, w.digest)
+		}
+	}
+	if w.err != nil {
+		os.Remove(w.file.Name())
+		return w.err
+	}
+	return w.cache.insert(w.digest, w.file.Name(), w.size)
+}
+
+// abort discards the content
+func (w *cacheWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
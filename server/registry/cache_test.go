@@ -0,0 +1,148 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipdr-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newDiskCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, d := []byte("aaaa"), []byte("bbbb"), []byte("dddd")
+	for _, content := range [][]byte{a, b} {
+		if err := c.add(computeDigest(content), content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.add(computeDigest(a), []byte("nope")); err == nil {
+		t.Fatal("expected content not matching the digest to be rejected")
+	}
+
+	// a is used last, b is evicted to make room for d
+	if got, ok := c.get(computeDigest(a)); !ok || string(got) != string(a) {
+		t.Fatalf("expected %s; got %s", a, got)
+	}
+	if err := c.add(computeDigest(d), d); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.get(computeDigest(b)); ok {
+		t.Fatal("expected the least recently used entry to be evicted")
+	}
+	st := c.Stats()
+	if st.Size != 8 || st.Entries != 2 || st.Hits != 1 || st.Misses != 1 || st.Evictions != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	// the entries and their order survive a restart
+	time.Sleep(10 * time.Millisecond)
+	c.get(computeDigest(a))
+	c, err = newDiskCache(dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.add(computeDigest(b), b); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.get(computeDigest(d)); ok {
+		t.Fatal("expected the least recently used entry to be evicted after a restart")
+	}
+	if _, ok := c.get(computeDigest(a)); !ok {
+		t.Fatal("expected the cache to survive a restart")
+	}
+}
+
+func TestBlobGetCached(t *testing.T) {
+	content := []byte("0123456789")
+	digest := computeDigest(content)
+	mf := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","layers":[]}`)
+	var requests int32
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch req.URL.Path {
+		case "/ipfs/bafytest/blobs/" + digest:
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+		case "/ipfs/bafytest/manifests/latest":
+			w.Write(mf)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer gw.Close()
+
+	dir, err := ioutil.TempDir("", "ipdr-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, srv, done := newTestRegistry(t, &Config{IPFSGateway: gw.URL, CacheDir: dir})
+	defer done()
+	r.cids.Add("foo", "latest", "bafytest")
+	r.cids.Add("foo", digest, "bafytest")
+
+	get := func(p, rangeHeader string) (int, string) {
+		req, _ := http.NewRequest("GET", srv.URL+p, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if status, b := get("/v2/foo/blobs/"+digest, ""); status != http.StatusOK || b != string(content) {
+		t.Fatalf("expected %s; got %d %s", content, status, b)
+	}
+	if status, _ := get("/v2/foo/manifests/latest", ""); status != http.StatusOK {
+		t.Fatalf("expected status 200; got %d", status)
+	}
+	n := atomic.LoadInt32(&requests)
+
+	// served from the cache, ranges included
+	if status, b := get("/v2/foo/blobs/"+digest, ""); status != http.StatusOK || b != string(content) {
+		t.Fatalf("expected %s; got %d %s", content, status, b)
+	}
+	if status, b := get("/v2/foo/blobs/"+digest, "bytes=2-4"); status != http.StatusPartialContent || b != "234" {
+		t.Fatalf("expected 234; got %d %s", status, b)
+	}
+	if status, b := get("/v2/foo/manifests/"+computeDigest(mf), ""); status != http.StatusOK || b != string(mf) {
+		t.Fatalf("expected %s; got %d %s", mf, status, b)
+	}
+	if got := atomic.LoadInt32(&requests); got != n {
+		t.Fatalf("expected no gateway request; got %d", got-n)
+	}
+	if _, ok := r.manifests.manifests["foo"]; ok {
+		t.Fatal("expected manifests read from IPFS not to be kept in memory")
+	}
+
+	resp, err := http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var st statusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Cache == nil || st.Cache.Entries != 2 || st.Cache.Hits != 3 {
+		t.Fatalf("unexpected cache stats %+v", st.Cache)
+	}
+}
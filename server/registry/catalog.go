@@ -0,0 +1,71 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+)
+
+// https://github.com/opencontainers/distribution-spec/blob/master/spec.md#pulling-manifests
+var repoRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*)*$`)
+
+// RepoLister is implemented by the CID resolvers that can enumerate the repositories they know.
+type RepoLister interface {
+	Repos() []string
+}
+
+func isCatalog(req *http.Request) bool {
+	return req.URL.Path == "/v2/_catalog"
+}
+
+type catalogResponse struct {
+	Repositories []string `json:"repositories"`
+}
+
+// https://docs.docker.com/registry/spec/api/#catalog
+// With an access policy, only the repos the user can pull are listed.
+func (r *registry) catalog(resp http.ResponseWriter, req *http.Request, user string) *regError {
+	if req.Method != "GET" {
+		return &regError{
+			Status:  http.StatusBadRequest,
+			Code:    "METHOD_UNKNOWN",
+			Message: "We don't understand your method + url",
+		}
+	}
+
+	list := r.cids.Repos()
+	if l, ok := r.resolver.(RepoLister); ok {
+		list = append(list, l.Repos()...)
+	}
+
+	repos := []string{}
+	for _, s := range uniq(list) {
+		if !repoRegexp.MatchString(s) {
+			continue
+		}
+		if r.policy != nil {
+			ok, err := r.policy.allows(user, s, "pull")
+			if err != nil {
+				r.log.Printf("policy %s: %v", r.policy.path, err)
+			}
+			if !ok {
+				continue
+			}
+		}
+		repos = append(repos, s)
+	}
+
+	page, link, rerr := paginate(repos, req)
+	if rerr != nil {
+		return rerr
+	}
+	if link != "" {
+		resp.Header().Set("Link", link)
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	json.NewEncoder(resp).Encode(catalogResponse{
+		Repositories: page,
+	})
+	return nil
+}
@@ -3,6 +3,7 @@ package registry
 import (
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -21,6 +22,15 @@ func key(repo, ref string) string {
 	return repo + ":" + ref
 }
 
+// splitKey is the inverse of key
+func splitKey(k string) (string, string) {
+	pc := strings.SplitN(k, ":", 2)
+	if len(pc) == 1 {
+		return pc[0], ""
+	}
+	return pc[0], pc[1]
+}
+
 func (r *cidStore) Add(repo, reference string, cid string) {
 	r.Lock()
 
@@ -53,6 +63,95 @@ func (r *cidStore) Get(repo, reference string) (string, bool) {
 	return val, ok
 }
 
+// Remove deletes the repo:reference entry in memory and on disk
+func (r *cidStore) Remove(repo, reference string) {
+	r.Lock()
+
+	k := key(repo, reference)
+	delete(r.cids, k)
+	r.removeCID(k)
+
+	r.Unlock()
+}
+
+// Refs returns the repo:reference keys that map to cid in memory and on disk
+func (r *cidStore) Refs(cid string) []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	var list []string
+	for k, v := range r.cids {
+		if v == cid {
+			list = append(list, k)
+		}
+	}
+
+	if r.location != "" {
+		filepath.Walk(r.location, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(r.location, p)
+			if err != nil {
+				return nil
+			}
+			rel = filepath.ToSlash(rel)
+			k := key(path.Dir(rel), path.Base(rel))
+			if v, err := r.readCID(k); err == nil && v == cid {
+				list = append(list, k)
+			}
+			return nil
+		})
+	}
+
+	return uniq(list)
+}
+
+// Tags returns the references of repo known in memory and on disk
+func (r *cidStore) Tags(repo string) []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	var list []string
+	prefix := key(repo, "")
+	for k := range r.cids {
+		if strings.HasPrefix(k, prefix) {
+			list = append(list, strings.TrimPrefix(k, prefix))
+		}
+	}
+
+	if r.location != "" {
+		files, _ := ioutil.ReadDir(filepath.Join(r.location, repo))
+		for _, f := range files {
+			if f.Mode().IsRegular() {
+				list = append(list, f.Name())
+			}
+		}
+	}
+
+	return uniq(list)
+}
+
+// Repos returns the repositories known in memory and on disk
+func (r *cidStore) Repos() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	var list []string
+	for k := range r.cids {
+		// repos pulled by CID only have digests recorded
+		if repo, ref := splitKey(k); !isDigest(ref) {
+			list = append(list, repo)
+		}
+	}
+
+	if r.location != "" {
+		list = append(list, walkRepos(r.location)...)
+	}
+
+	return uniq(list)
+}
+
 func (r *cidStore) readCID(key string) (string, error) {
 	pc := strings.SplitN(key, ":", 2)
 	p := filepath.Join(r.location, strings.Join(pc, "/"))
@@ -73,6 +172,12 @@ func (r *cidStore) writeCID(key string, val string) error {
 	return ioutil.WriteFile(p, []byte(val), 0644)
 }
 
+func (r *cidStore) removeCID(key string) error {
+	pc := strings.SplitN(key, ":", 2)
+	p := filepath.Join(r.location, strings.Join(pc, "/"))
+	return os.Remove(p)
+}
+
 func newCIDStore(location string) *cidStore {
 
 	return &cidStore{
@@ -0,0 +1,256 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Content sources manifests and blobs are read from
+const (
+	// ContentGateway reads content from the IPFS gateways
+	ContentGateway = "gateway"
+	// ContentAPI reads content through the IPFS HTTP API, for nodes that don't expose a gateway
+	ContentAPI = "api"
+)
+
+// blobContent is an open blob, or a range of it
+type blobContent struct {
+	io.ReadCloser
+	// http.StatusOK or http.StatusPartialContent
+	status int
+	// length of the content, -1 when unknown
+	length       int64
+	contentRange string
+}
+
+// contentSources returns the configured content source followed by the other one as a fallback
+func (r *registry) contentSources() []string {
+	if r.config.ContentSource == ContentAPI {
+		return []string{ContentAPI, ContentGateway}
+	}
+	return []string{ContentGateway, ContentAPI}
+}
+
+// readContent returns the content of the file at cid/s from the first content source that has it.
+// The error of the configured source is returned when none has it.
+func (r *registry) readContent(cid string, s []string) ([]byte, error) {
+	var first error
+	for _, src := range r.contentSources() {
+		var b []byte
+		var err error
+		switch {
+		case src == ContentAPI:
+			b, err = r.catContent(path.Join(append([]string{cid}, s...)...))
+		case r.trustless != nil:
+			b, err = r.trustless.get(cid, s)
+		default:
+			b, err = getContent(r.gateways, cid, s)
+		}
+		if err == nil {
+			return b, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return nil, first
+}
+
+func (r *registry) catContent(p string) ([]byte, error) {
+	rc, err := r.ipfsClient.Cat(p)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// openBlob opens the blob, or the range of it, from the first content source that has it.
+// The error of the configured source is returned when none has it.
+func (r *registry) openBlob(cid, digest, rangeHeader string) (*blobContent, *regError) {
+	var first *regError
+	for _, src := range r.contentSources() {
+		var bc *blobContent
+		var rerr *regError
+		switch {
+		case src == ContentAPI:
+			bc, rerr = r.openBlobAPI(cid, digest, rangeHeader)
+		case r.trustless != nil:
+			bc, rerr = r.openBlobTrustless(cid, digest)
+		default:
+			bc, rerr = r.openBlobGateway(cid, digest, rangeHeader)
+		}
+		if rerr == nil {
+			return bc, nil
+		}
+		// the blob exists but the range doesn't
+		if rerr.Status == http.StatusRequestedRangeNotSatisfiable {
+			return nil, rerr
+		}
+		if first == nil {
+			first = rerr
+		}
+	}
+	return nil, first
+}
+
+// openBlobGateway lets the gateway serve partial content so interrupted pulls can resume
+func (r *registry) openBlobGateway(cid, digest, rangeHeader string) (*blobContent, *regError) {
+	header := http.Header{}
+	if rangeHeader != "" {
+		header.Set("Range", rangeHeader)
+	}
+	ipfsResp, err := r.gateways.Do("GET", path.Join(cid, "blobs", digest), header)
+	if err != nil {
+		return nil, &regError{
+			Status:  http.StatusNotFound,
+			Code:    "BLOB_UNKNOWN",
+			Message: err.Error(),
+		}
+	}
+	switch ipfsResp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		ipfsResp.Body.Close()
+		return nil, &regError{
+			Status:  http.StatusRequestedRangeNotSatisfiable,
+			Code:    "BLOB_UNKNOWN",
+			Message: ipfsResp.Status,
+		}
+	default:
+		ipfsResp.Body.Close()
+		return nil, &regError{
+			Status:  http.StatusNotFound,
+			Code:    "BLOB_UNKNOWN",
+			Message: ipfsResp.Status,
+		}
+	}
+
+	// the gateway is not trusted, content that can't match the digest is rejected before it's sent
+	if info, ok := r.index.Get(digest); ok && ipfsResp.StatusCode == http.StatusOK && ipfsResp.ContentLength >= 0 && ipfsResp.ContentLength != info.Size {
+		ipfsResp.Body.Close()
+		return nil, &regError{
+			Status:  http.StatusBadGateway,
+			Code:    "BLOB_UNKNOWN",
+			Message: fmt.Sprintf("gateway returned %d bytes, expected %d", ipfsResp.ContentLength, info.Size),
+		}
+	}
+
+	return &blobContent{
+		ReadCloser:   ipfsResp.Body,
+		status:       ipfsResp.StatusCode,
+		length:       ipfsResp.ContentLength,
+		contentRange: ipfsResp.Header.Get("Content-Range"),
+	}, nil
+}
+
+// openBlobTrustless streams the blob from raw blocks verified against the CID.
+// Ranges are ignored, the complete blob is sent.
+func (r *registry) openBlobTrustless(cid, digest string) (*blobContent, *regError) {
+	size, err := r.blobs.size(cid, digest)
+	if err != nil {
+		return nil, &regError{
+			Status:  http.StatusNotFound,
+			Code:    "BLOB_UNKNOWN",
+			Message: err.Error(),
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(r.trustless.copy(pw, cid, []string{"blobs", digest}))
+	}()
+	return &blobContent{
+		ReadCloser: pr,
+		status:     http.StatusOK,
+		length:     size,
+	}, nil
+}
+
+// openBlobAPI streams the blob, or the range of it, through the IPFS HTTP API
+func (r *registry) openBlobAPI(cid, digest, rangeHeader string) (*blobContent, *regError) {
+	p := path.Join(cid, "blobs", digest)
+	size, err := r.blobs.size(cid, digest)
+	if err != nil {
+		return nil, &regError{
+			Status:  http.StatusNotFound,
+			Code:    "BLOB_UNKNOWN",
+			Message: err.Error(),
+		}
+	}
+
+	bc := &blobContent{
+		status: http.StatusOK,
+		length: size,
+	}
+	var offset int64
+	length := int64(-1)
+	if rangeHeader != "" {
+		start, end, ok := parseRange(rangeHeader, size)
+		if !ok {
+			return nil, &regError{
+				Status:  http.StatusRequestedRangeNotSatisfiable,
+				Code:    "BLOB_UNKNOWN",
+				Message: "invalid range " + rangeHeader,
+			}
+		}
+		offset, length = start, end-start+1
+		bc.status = http.StatusPartialContent
+		bc.length = length
+		bc.contentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, size)
+	}
+
+	rc, err := r.ipfsClient.CatRange(p, offset, length)
+	if err != nil {
+		return nil, &regError{
+			Status:  http.StatusNotFound,
+			Code:    "BLOB_UNKNOWN",
+			Message: err.Error(),
+		}
+	}
+	bc.ReadCloser = rc
+	return bc, nil
+}
+
+// parseRange returns the first and last byte of a single range, e.g. bytes=0-99, bytes=100- or bytes=-100
+// https://tools.ietf.org/html/rfc7233#section-2.1
+func parseRange(s string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return 0, 0, false
+	}
+	sa := strings.SplitN(strings.TrimPrefix(s, "bytes="), "-", 2)
+	if len(sa) != 2 {
+		return 0, 0, false
+	}
+	first, last := strings.TrimSpace(sa[0]), strings.TrimSpace(sa[1])
+	if first == "" {
+		// suffix
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, size > 0
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
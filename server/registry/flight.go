@@ -0,0 +1,91 @@
+package registry
+
+import "sync"
+
+// flightGroup coalesces concurrent calls with the same key,
+// the callers that arrive while a call is in flight wait for it and share its result.
+type flightGroup struct {
+	calls map[string]*flightCall
+	lock  sync.Mutex
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+	// callers waiting for the result
+	dups int
+}
+
+// do calls fn unless a call for key is already in flight, in which case it waits for its result
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.lock.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+	if c, ok := g.calls[key]; ok {
+		c.dups++
+		g.lock.Unlock()
+		<-c.done
+		return c.val, c.err
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.lock.Unlock()
+
+	defer func() {
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		close(c.done)
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err
+}
+
+// waiting returns the number of callers waiting for the call for key in flight
+func (g *flightGroup) waiting(key string) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if c, ok := g.calls[key]; ok {
+		return c.dups
+	}
+	return 0
+}
+
+// keyLock is a mutex per key, e.g. per repo, so that unrelated keys never wait on each other
+type keyLock struct {
+	locks map[string]*keyMutex
+	lock  sync.Mutex
+}
+
+type keyMutex struct {
+	sync.Mutex
+	// number of holders and waiters
+	refs int
+}
+
+// acquire locks key and returns the func that unlocks it
+func (l *keyLock) acquire(key string) func() {
+	l.lock.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*keyMutex{}
+	}
+	m, ok := l.locks[key]
+	if !ok {
+		m = &keyMutex{}
+		l.locks[key] = m
+	}
+	m.refs++
+	l.lock.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+		l.lock.Lock()
+		if m.refs--; m.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.lock.Unlock()
+	}
+}
@@ -0,0 +1,284 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errHTTPNotFound = errors.New("not found")
+
+const (
+	// how long a 404 is cached when the response has no max-age
+	httpNegativeTTL = 30 * time.Second
+	// maximum number of cached responses
+	httpCacheSize = 1024
+)
+
+// HTTP resolver
+// The URI either points to a JSON index of every mapping, when its path ends with .json:
+//
+//	[{"repo": "app", "tag": "v1", "cid": "bafy...", "digest": "sha256:..."}]
+//
+// or to a base URL serving the CID of every reference as text at <base>/<repo>/<reference>
+// and the JSON array of the references of a repo at <base>/<repo>/
+//
+// Responses are cached as long as their Cache-Control max-age allows and revalidated with their ETag.
+// Not found responses are cached too, for 30 seconds unless their max-age says otherwise.
+type httpResolver struct {
+	uri    string
+	index  bool
+	token  string
+	client *http.Client
+
+	// maps URL -> cached response, bounded by httpCacheSize
+	cache map[string]*httpCacheEntry
+	// last error, cleared by the next successful request
+	err error
+
+	sync.Mutex
+}
+
+type httpCacheEntry struct {
+	body     []byte
+	etag     string
+	expires  time.Time
+	notFound bool
+}
+
+type httpIndexEntry struct {
+	Repo   string `json:"repo"`
+	Tag    string `json:"tag"`
+	CID    string `json:"cid"`
+	Digest string `json:"digest"`
+}
+
+func NewHTTPResolver(uri, token string) (CIDResolver, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("not supported: %s", uri)
+	}
+	return &httpResolver{
+		uri:    uri,
+		index:  strings.HasSuffix(u.Path, ".json"),
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+		cache:  map[string]*httpCacheEntry{},
+	}, nil
+}
+
+func (r *httpResolver) Resolve(repo, reference string) []string {
+	if r.index {
+		entries, err := r.entries()
+		if err != nil {
+			return nil
+		}
+		var list []string
+		for _, e := range entries {
+			if e.Repo != repo {
+				continue
+			}
+			if reference == "" {
+				if e.Tag != "" {
+					list = append(list, e.Tag)
+				}
+				continue
+			}
+			if e.Tag == reference || e.Digest == reference {
+				return []string{e.CID}
+			}
+		}
+		return list
+	}
+
+	base := strings.TrimSuffix(r.uri, "/")
+	if reference == "" {
+		b, err := r.get(base + "/" + repo + "/")
+		if err != nil {
+			return nil
+		}
+		var list []string
+		if err := json.Unmarshal(b, &list); err != nil {
+			return nil
+		}
+		return list
+	}
+
+	b, err := r.get(base + "/" + repo + "/" + reference)
+	if err != nil {
+		return nil
+	}
+	return []string{strings.TrimSpace(string(b))}
+}
+
+// Repos returns the repositories of the index. Repositories can't be listed from a base URL.
+func (r *httpResolver) Repos() []string {
+	if !r.index {
+		return nil
+	}
+	entries, err := r.entries()
+	if err != nil {
+		return nil
+	}
+	var list []string
+	for _, e := range entries {
+		list = append(list, e.Repo)
+	}
+	return uniq(list)
+}
+
+func (r *httpResolver) Status() ResolverStatus {
+	r.Lock()
+	defer r.Unlock()
+	st := ResolverStatus{
+		Source: r.uri,
+		Root:   r.uri,
+	}
+	if r.err != nil {
+		st.Error = r.err.Error()
+	}
+	return st
+}
+
+func (r *httpResolver) entries() ([]*httpIndexEntry, error) {
+	b, err := r.get(r.uri)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*httpIndexEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		r.setErr(err)
+		return nil, err
+	}
+	return entries, nil
+}
+
+// get returns the body of the URL. The cached body is returned while fresh,
+// or when the server can't be reached.
+func (r *httpResolver) get(u string) ([]byte, error) {
+	r.Lock()
+	entry := r.cache[u]
+	r.Unlock()
+	if entry != nil && time.Now().Before(entry.expires) {
+		if entry.notFound {
+			return nil, errHTTPNotFound
+		}
+		return entry.body, nil
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	if entry != nil && entry.etag != "" {
+		req.Header.Set("If-None-Match", entry.etag)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return r.stale(entry, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && entry != nil && !entry.notFound:
+		r.store(u, &httpCacheEntry{
+			body:    entry.body,
+			etag:    entry.etag,
+			expires: time.Now().Add(maxAge(resp.Header)),
+		})
+		return entry.body, nil
+	case resp.StatusCode == http.StatusOK:
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return r.stale(entry, err)
+		}
+		r.store(u, &httpCacheEntry{
+			body:    b,
+			etag:    resp.Header.Get("ETag"),
+			expires: time.Now().Add(maxAge(resp.Header)),
+		})
+		return b, nil
+	case resp.StatusCode == http.StatusNotFound:
+		ttl := maxAge(resp.Header)
+		if ttl <= 0 {
+			ttl = httpNegativeTTL
+		}
+		r.store(u, &httpCacheEntry{
+			expires:  time.Now().Add(ttl),
+			notFound: true,
+		})
+		return nil, errHTTPNotFound
+	default:
+		return r.stale(entry, fmt.Errorf("%s: %s", u, resp.Status))
+	}
+}
+
+// stale records the error and returns the cached body if any
+func (r *httpResolver) stale(entry *httpCacheEntry, err error) ([]byte, error) {
+	r.setErr(err)
+	if entry != nil {
+		if entry.notFound {
+			return nil, errHTTPNotFound
+		}
+		return entry.body, nil
+	}
+	return nil, err
+}
+
+// store caches the response. When the cache is full the expired responses are evicted,
+// or the one expiring first if none is.
+func (r *httpResolver) store(u string, entry *httpCacheEntry) {
+	r.Lock()
+	defer r.Unlock()
+	r.err = nil
+	if _, ok := r.cache[u]; !ok && len(r.cache) >= httpCacheSize {
+		now := time.Now()
+		var oldest string
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			} else if oldest == "" || e.expires.Before(r.cache[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(r.cache) >= httpCacheSize {
+			delete(r.cache, oldest)
+		}
+	}
+	r.cache[u] = entry
+}
+
+func (r *httpResolver) setErr(err error) {
+	r.Lock()
+	r.err = err
+	r.Unlock()
+}
+
+// maxAge returns how long a response may be cached according to its Cache-Control header
+func maxAge(h http.Header) time.Duration {
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d == "no-cache" || d == "no-store" {
+			return 0
+		}
+		if strings.HasPrefix(d, "max-age=") {
+			if n, err := strconv.Atoi(strings.TrimPrefix(d, "max-age=")); err == nil {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+	return 0
+}
@@ -21,9 +21,19 @@ package image
 
 const ManifestVersion = 2
 const ManifestType = "application/vnd.docker.distribution.manifest.v2+json"
+const ManifestListType = "application/vnd.docker.distribution.manifest.list.v2+json"
 const ConfigType = "application/vnd.docker.container.image.v1+json"
 const LayerType = "application/vnd.docker.image.rootfs.diff.tar.gzip"
 
+// OCI image spec media types
+// https://github.com/opencontainers/image-spec/blob/master/media-types.md
+const OCIManifestType = "application/vnd.oci.image.manifest.v1+json"
+const OCIIndexType = "application/vnd.oci.image.index.v1+json"
+const OCIConfigType = "application/vnd.oci.image.config.v1+json"
+const OCILayerType = "application/vnd.oci.image.layer.v1.tar"
+const OCILayerGzipType = "application/vnd.oci.image.layer.v1.tar+gzip"
+const OCILayerZstdType = "application/vnd.oci.image.layer.v1.tar+zstd"
+
 type Config struct {
 	MediaType string `json:"mediaType"`
 	Size      int64  `json:"size"`
@@ -34,17 +44,66 @@ type Layer struct {
 	Size      int64  `json:"size"`
 	Digest    string `json:"digest"`
 }
+
+// Platform describes the platform of a manifest referenced by an index
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Descriptor references a manifest in an index or manifest list
+type Descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Size      int64     `json:"size"`
+	Digest    string    `json:"digest"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+// Manifest is an image manifest or, if Manifests is set, an index (manifest list)
 type Manifest struct {
-	SchemaVersion int      `json:"schemaVersion"`
-	MediaType     string   `json:"mediaType"`
-	Config        *Config  `json:"config"`
-	Layers        []*Layer `json:"layers"`
+	SchemaVersion int           `json:"schemaVersion"`
+	MediaType     string        `json:"mediaType"`
+	Config        *Config       `json:"config"`
+	Layers        []*Layer      `json:"layers"`
+	Manifests     []*Descriptor `json:"manifests,omitempty"`
+}
+
+// IsIndex returns whether the media type is an OCI index or a Docker manifest list
+func IsIndex(mediaType string) bool {
+	return mediaType == OCIIndexType || mediaType == ManifestListType
 }
 
+// IsIndex returns whether the manifest is an OCI index or a Docker manifest list
+func (r *Manifest) IsIndex() bool {
+	return IsIndex(r.MediaType)
+}
+
+// Digests returns the digests of the content the manifest references:
+// the config and layers of an image manifest or the manifests of an index
 func (r *Manifest) Digests() []string {
-	digests := []string{r.Config.Digest}
+	var digests []string
+	if r.Config != nil {
+		digests = append(digests, r.Config.Digest)
+	}
 	for _, l := range r.Layers {
 		digests = append(digests, l.Digest)
 	}
+	for _, m := range r.Manifests {
+		digests = append(digests, m.Digest)
+	}
 	return digests
 }
+
+// Descriptors returns the descriptors of the content the manifest references:
+// the config and layers of an image manifest or the manifests of an index
+func (r *Manifest) Descriptors() []*Descriptor {
+	var list []*Descriptor
+	if r.Config != nil {
+		list = append(list, &Descriptor{MediaType: r.Config.MediaType, Size: r.Config.Size, Digest: r.Config.Digest})
+	}
+	for _, l := range r.Layers {
+		list = append(list, &Descriptor{MediaType: l.MediaType, Size: l.Size, Digest: l.Digest})
+	}
+	return append(list, r.Manifests...)
+}
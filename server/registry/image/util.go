@@ -9,5 +9,16 @@ func DecodeManifest(b []byte) (*Manifest, error) {
 	if err := json.Unmarshal(b, &m); err != nil {
 		return nil, err
 	}
+	// mediaType is optional in OCI manifests and indexes
+	if m.MediaType == "" {
+		switch {
+		case m.Manifests != nil:
+			m.MediaType = OCIIndexType
+		case m.Config != nil && m.Config.MediaType == ConfigType:
+			m.MediaType = ManifestType
+		case m.Config != nil:
+			m.MediaType = OCIManifestType
+		}
+	}
 	return &m, nil
 }
@@ -21,11 +21,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"path"
 	"strings"
 	"sync"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/miguelmota/ipdr/server/registry/image"
 )
 
@@ -36,13 +36,23 @@ type manifest struct {
 }
 
 type manifests struct {
-	// maps repo -> manifest tag/digest -> manifest
+	// maps repo -> manifest tag/digest -> manifest of the pushed manifests
 	manifests map[string]map[string]*manifest
-	lock      sync.Mutex
+	// lock guards manifests only, it's never held across IPFS or resolver requests
+	lock sync.RWMutex
+	// pushes and deletions of a repo are serialized, other repos don't wait on them
+	repos keyLock
+	// concurrent fetches of the same repo:reference share one fetch
+	flight flightGroup
 
 	registry *registry
 }
 
+type fetched struct {
+	mf  *manifest
+	cid string
+}
+
 func isManifest(req *http.Request) bool {
 	elems := strings.Split(req.URL.Path, "/")
 	elems = elems[1:]
@@ -61,10 +71,7 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 	repo := strings.Join(elem[1:len(elem)-2], "/")
 
 	if req.Method == "GET" {
-		m.lock.Lock()
-		defer m.lock.Unlock()
-
-		mf, err := m.fetch(repo, target)
+		mf, cid, err := m.fetch(repo, target)
 		if err != nil {
 			return &regError{
 				Status:  http.StatusNotFound,
@@ -72,24 +79,34 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 				Message: err.Error(),
 			}
 		}
-
-		// Prepare reverse lookup by digest for pulling blobs from IPFS
-		cid, err := m.registry.resolveCID(repo, target)
-		if err != nil {
+		if !accepts(req, mf.contentType) {
 			return &regError{
 				Status:  http.StatusNotFound,
 				Code:    "MANIFEST_UNKNOWN",
-				Message: err.Error(),
+				Message: fmt.Sprintf("manifest media type %s not accepted", mf.contentType),
 			}
 		}
-		f, _ := image.DecodeManifest(mf.blob)
 
-		for _, d := range f.Digests() {
-			m.registry.cids.Add(repo, d, cid)
+		// Prepare reverse lookup by digest for pulling blobs from IPFS.
+		// Images served from upstream are not in IPFS until they are mirrored.
+		if cid == "" && m.registry.upstream == nil {
+			return &regError{
+				Status:  http.StatusNotFound,
+				Code:    "MANIFEST_UNKNOWN",
+				Message: fmt.Sprintf("cannot resolve CID: %s:%s", repo, target),
+			}
 		}
+		if f, err := image.DecodeManifest(mf.blob); err == nil && cid != "" {
+			for _, d := range f.Digests() {
+				m.registry.cids.Add(repo, d, cid)
+			}
+		}
+		m.registry.indexManifest(cid, mf.blob)
 
 		resp.Header().Set("Docker-Content-Digest", mf.digest)
-		resp.Header().Set("X-Docker-Content-ID", cid)
+		if cid != "" {
+			resp.Header().Set("X-Docker-Content-ID", cid)
+		}
 		resp.Header().Set("Content-Type", mf.contentType)
 		resp.Header().Set("Content-Length", fmt.Sprint(len(mf.blob)))
 		resp.WriteHeader(http.StatusOK)
@@ -98,10 +115,7 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 	}
 
 	if req.Method == "HEAD" {
-		m.lock.Lock()
-		defer m.lock.Unlock()
-
-		mf, err := m.fetch(repo, target)
+		mf, _, err := m.fetch(repo, target)
 		if err != nil {
 			return &regError{
 				Status:  http.StatusNotFound,
@@ -109,6 +123,13 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 				Message: err.Error(),
 			}
 		}
+		if !accepts(req, mf.contentType) {
+			return &regError{
+				Status:  http.StatusNotFound,
+				Code:    "MANIFEST_UNKNOWN",
+				Message: fmt.Sprintf("manifest media type %s not accepted", mf.contentType),
+			}
+		}
 
 		resp.Header().Set("Docker-Content-Digest", mf.digest)
 		resp.Header().Set("Content-Type", mf.contentType)
@@ -118,12 +139,9 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 	}
 
 	if req.Method == "PUT" {
-		m.lock.Lock()
-		defer m.lock.Unlock()
+		unlock := m.repos.acquire(repo)
+		defer unlock()
 
-		if _, ok := m.manifests[repo]; !ok {
-			m.manifests[repo] = map[string]*manifest{}
-		}
 		b := &bytes.Buffer{}
 		io.Copy(b, req.Body)
 
@@ -131,14 +149,26 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 		mf := manifest{
 			blob:        b.Bytes(),
 			contentType: req.Header.Get("Content-Type"),
+			digest:      digest,
+		}
+
+		f, err := image.DecodeManifest(mf.blob)
+		if err != nil {
+			return &regError{
+				Status:  http.StatusBadRequest,
+				Code:    "MANIFEST_INVALID",
+				Message: err.Error(),
+			}
+		}
+		if mf.contentType == "" {
+			mf.contentType = f.MediaType
 		}
 
 		// If the manifest is a manifest list, check that the manifest
-		// list's constituent manifests are already uploaded.
+		// list's constituent manifests are already uploaded or in IPFS.
 		// This isn't strictly required by the registry API, but some
 		// registries require this.
-		if mf.contentType == string(types.OCIImageIndex) ||
-			mf.contentType == string(types.DockerManifestList) {
+		if image.IsIndex(mf.contentType) {
 
 			im, err := v1.ParseIndexManifest(b)
 			if err != nil {
@@ -149,7 +179,7 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 				}
 			}
 			for _, desc := range im.Manifests {
-				if _, found := m.manifests[repo][desc.Digest.String()]; !found {
+				if _, err := m.child(repo, desc.Digest.String()); err != nil {
 					return &regError{
 						Status:  http.StatusNotFound,
 						Code:    "MANIFEST_UNKNOWN",
@@ -161,26 +191,74 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 
 		// Allow future references by target (tag) and immutable digest.
 		// See https://docs.docker.com/engine/reference/commandline/pull/#pull-an-image-by-digest-immutable-identifier.
+		m.lock.Lock()
+		if _, ok := m.manifests[repo]; !ok {
+			m.manifests[repo] = map[string]*manifest{}
+		}
 		m.manifests[repo][target] = &mf
 		m.manifests[repo][digest] = &mf
+		m.lock.Unlock()
 
-		layers, ok := m.registry.blobs.get(repo)
-		if !ok {
+		// Manifests pushed by digest are added to IPFS like tagged ones, nothing tells whether an index will follow.
+		// An index links the blobs of its platform manifests so that every platform ends up in the same CID directory.
+		refs := make(map[string][]byte)
+		refs[target] = mf.blob
+		refs[digest] = mf.blob
+		refs["latest"] = mf.blob // <cid>/latest
+
+		// the blobs are collected by digest, other pushes to the repo may be in progress
+		digests := f.Digests()
+		if f.IsIndex() {
+			digests = nil
+			for _, desc := range f.Manifests {
+				child, err := m.child(repo, desc.Digest)
+				if err != nil {
+					return &regError{
+						Status:  http.StatusNotFound,
+						Code:    "MANIFEST_UNKNOWN",
+						Message: fmt.Sprintf("Sub-manifest %q not found", desc.Digest),
+					}
+				}
+				refs[desc.Digest] = child.blob
+				if cf, err := image.DecodeManifest(child.blob); err == nil {
+					digests = append(digests, cf.Digests()...)
+				}
+			}
+		}
+		layers, missing := m.registry.blobs.collect(digests)
+		var held []string
+		for d := range layers {
+			held = append(held, d)
+		}
+		pushed := false
+		defer func() {
+			m.registry.blobs.release(held, pushed)
+		}()
+
+		// blobs that were not pushed, e.g. when retagging or promoting an image,
+		// are linked from the CID directories already holding them
+		var unknown []string
+		for _, d := range missing {
+			// with access control, blobs of other repos have to be mounted, which checks the from repo can be pulled
+			if m.registry.restricted() && !m.registry.blobs.references(repo, d) {
+				unknown = append(unknown, d)
+				continue
+			}
+			c, err := m.registry.blobs.locate(repo, d)
+			if err != nil {
+				unknown = append(unknown, d)
+				continue
+			}
+			layers[d] = "/" + path.Join("ipfs", c, "blobs", d)
+		}
+		if len(unknown) > 0 {
 			return &regError{
 				Status:  http.StatusNotFound,
 				Code:    "MANIFEST_BLOB_UNKNOWN",
-				Message: fmt.Sprintf("layers for %q not found", repo),
+				Message: fmt.Sprintf("blobs %v of %q not found", unknown, repo),
 			}
 		}
 
-		// TODO cache e.g. move to disk?
-		m.registry.blobs.remove(repo)
-
-		refs := make(map[string][]byte)
-		refs[target] = mf.blob
-		refs[digest] = mf.blob
-		refs["latest"] = mf.blob // <cid>/latest
-
 		cid, err := m.registry.ipfsClient.AddImage(refs, layers)
 		if err != nil {
 			return &regError{
@@ -192,13 +270,98 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 
 		m.registry.cids.Add(repo, target, cid)
 		m.registry.cids.Add(repo, digest, cid)
-		m.registry.cids.Add(cid, "latest", cid) // <cid>/latest
+		for _, desc := range f.Manifests {
+			m.registry.cids.Add(repo, desc.Digest, cid)
+		}
+		// reverse lookup by digest for pulling and mounting blobs
+		for d := range layers {
+			m.registry.cids.Add(repo, d, cid)
+		}
+		for ref, b := range refs {
+			if isDigest(ref) {
+				m.registry.indexManifest(cid, b)
+			}
+		}
+
+		// the blobs are in IPFS now, and can be found there by other pushes
+		pushed = true
 
 		resp.Header().Set("Docker-Content-Digest", digest)
 		resp.Header().Set("X-Docker-Content-ID", cid)
 		resp.WriteHeader(http.StatusCreated)
 		return nil
 	}
+	if req.Method == "DELETE" {
+		if m.registry.config.DisableDelete {
+			return &regError{
+				Status:  http.StatusMethodNotAllowed,
+				Code:    "UNSUPPORTED",
+				Message: "manifest deletion is disabled",
+			}
+		}
+
+		unlock := m.repos.acquire(repo)
+		defer unlock()
+
+		cid, ok := m.registry.cids.Get(repo, target)
+		if !ok && isDigest(target) {
+			cid, ok = m.tagCID(repo, target)
+		}
+		if !ok {
+			return &regError{
+				Status:  http.StatusNotFound,
+				Code:    "MANIFEST_UNKNOWN",
+				Message: fmt.Sprintf("%s:%s not found", repo, target),
+			}
+		}
+		// read before the references go, an index lists the platform manifests to unpin along with it
+		var deleted *manifest
+		if m.registry.config.UnpinOnDelete {
+			if mf, ok := m.pushed(repo, target); ok {
+				deleted = mf
+			} else if mf, err := m.getManifest(cid, target); err == nil {
+				deleted = mf
+			}
+		}
+
+		m.registry.cids.Remove(repo, target)
+		m.lock.Lock()
+		delete(m.manifests[repo], target)
+		m.lock.Unlock()
+
+		// deleting by digest removes the manifest along with every tag of the repo pointing to it
+		if isDigest(target) {
+			for _, k := range m.registry.cids.Refs(cid) {
+				if r, ref := splitKey(k); r == repo {
+					m.registry.cids.Remove(r, ref)
+				}
+			}
+			m.lock.Lock()
+			for ref, mf := range m.manifests[repo] {
+				if mf.digest == target {
+					delete(m.manifests[repo], ref)
+				}
+			}
+			m.lock.Unlock()
+		}
+
+		if m.registry.config.UnpinOnDelete && !m.tagged(cid) {
+			if err := m.registry.ipfsClient.Unpin(cid); err != nil {
+				m.registry.log.Printf("unpin %s: %v", cid, err)
+			}
+			if deleted != nil {
+				for _, c := range m.platformCIDs(cid, deleted.blob) {
+					if err := m.registry.ipfsClient.Unpin(c); err != nil {
+						m.registry.log.Printf("unpin %s: %v", c, err)
+					}
+				}
+			}
+		}
+
+		resp.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+
 	return &regError{
 		Status:  http.StatusBadRequest,
 		Code:    "METHOD_UNKNOWN",
@@ -206,33 +369,153 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 	}
 }
 
-func (m *manifests) fetch(repo, target string) (*manifest, error) {
-	if _, ok := m.manifests[repo]; !ok {
-		m.manifests[repo] = map[string]*manifest{}
+// tagCID returns the CID a tag of repo points to that holds the manifest with the digest.
+// Digest references are only kept in memory, the blob index finds them after a restart.
+func (m *manifests) tagCID(repo, digest string) (string, bool) {
+	info, ok := m.registry.index.Get(digest)
+	if !ok {
+		return "", false
 	}
-	mf, ok := m.manifests[repo][target]
-	if ok {
+	for _, tag := range m.registry.cids.Tags(repo) {
+		cid, ok := m.registry.cids.Get(repo, tag)
+		if !ok {
+			continue
+		}
+		for _, c := range info.CIDs {
+			if c == cid {
+				return cid, true
+			}
+		}
+	}
+	return "", false
+}
+
+// tagged returns whether any repo still has a tag pointing to cid
+func (m *manifests) tagged(cid string) bool {
+	for _, k := range m.registry.cids.Refs(cid) {
+		if _, ref := splitKey(k); !isDigest(ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// platformCIDs returns the CIDs the platform manifests of the index in cid were added to
+// when pushed by digest before it, which nothing references anymore
+func (m *manifests) platformCIDs(cid string, b []byte) []string {
+	f, err := image.DecodeManifest(b)
+	if err != nil || !f.IsIndex() {
+		return nil
+	}
+	var list []string
+	for _, desc := range f.Manifests {
+		info, ok := m.registry.index.Get(desc.Digest)
+		if !ok {
+			continue
+		}
+		for _, c := range info.CIDs {
+			if c != cid && len(m.registry.cids.Refs(c)) == 0 {
+				list = append(list, c)
+			}
+		}
+	}
+	return uniq(list)
+}
+
+// child returns the manifest with the digest pushed to repo, or read from IPFS
+// through repo or a CID directory the blob index knows to hold it
+func (m *manifests) child(repo, digest string) (*manifest, error) {
+	if mf, ok := m.pushed(repo, digest); ok {
 		return mf, nil
 	}
+	if info, ok := m.registry.index.Get(digest); ok {
+		for _, cid := range info.CIDs {
+			if mf, err := m.getManifest(cid, digest); err == nil {
+				return mf, nil
+			}
+		}
+	}
+	mf, _, err := m.fetch(repo, digest)
+	return mf, err
+}
 
-	cid, err := m.registry.resolveCID(repo, target)
-	if err != nil {
-		return nil, err
+// pushed returns the manifest pushed to repo:reference
+func (m *manifests) pushed(repo, reference string) (*manifest, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	mf, ok := m.manifests[repo][reference]
+	return mf, ok
+}
+
+// fetch returns the manifest pushed to repo:target, or reads it from IPFS, along with the CID holding it.
+// The CID is empty when the manifest is not in IPFS (yet).
+// Manifests read from IPFS are not kept in memory, they are cached on disk by digest.
+func (m *manifests) fetch(repo, target string) (*manifest, string, error) {
+	if mf, ok := m.pushed(repo, target); ok {
+		cid, _ := m.registry.resolveCID(repo, target)
+		return mf, cid, nil
 	}
 
-	mf, err = m.getManifest(cid, target)
-	if err != nil {
-		return nil, err
+	// the cache is only used for digests the repo still references, deleted manifests are gone
+	if cid, ok := m.registry.cids.Get(repo, target); ok && isDigest(target) && m.registry.cache != nil {
+		if b, ok := m.registry.cache.get(target); ok {
+			if mf, err := decodeManifest(b); err == nil {
+				return mf, cid, nil
+			}
+		}
 	}
 
-	m.manifests[repo][target] = mf
-	m.manifests[repo][mf.digest] = mf
+	v, err := m.flight.do(key(repo, target), func() (interface{}, error) {
+		var mf *manifest
+		cid, err := m.registry.resolveCID(repo, target)
+		if err == nil && m.registry.upstream != nil && m.registry.upstream.moved(repo, target, cid) {
+			err = fmt.Errorf("%s:%s moved upstream", repo, target)
+		}
+		if err != nil && m.registry.upstream != nil {
+			mf, cid, err = m.registry.upstream.manifest(repo, target)
+		} else if err == nil {
+			mf, err = m.getManifest(cid, target)
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	// conform to the distribution registry specification
-	// in case target is tag, we need to resolve also by hash.
-	m.registry.cids.Add(repo, mf.digest, cid)
+		if m.registry.cache != nil {
+			if err := m.registry.cache.add(mf.digest, mf.blob); err != nil {
+				m.registry.log.Printf("cache %s: %v", mf.digest, err)
+			}
+		}
 
-	return mf, nil
+		// conform to the distribution registry specification
+		// in case target is tag, we need to resolve also by hash.
+		if cid != "" {
+			m.registry.cids.Add(repo, mf.digest, cid)
+		}
+		return &fetched{mf: mf, cid: cid}, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	f := v.(*fetched)
+	return f.mf, f.cid, nil
+}
+
+// accepts returns whether the Accept headers of the request allow the media type.
+// Clients that send no Accept header are assumed to accept any manifest.
+func accepts(req *http.Request, mediaType string) bool {
+	values := req.Header["Accept"]
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			t := strings.TrimSpace(strings.SplitN(s, ";", 2)[0])
+			if t == mediaType || t == "*/*" {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func computeDigest(b []byte) string {
@@ -242,18 +525,45 @@ func computeDigest(b []byte) string {
 }
 
 func (m *manifests) getManifest(cid, target string) (*manifest, error) {
-	b, err := getContent(m.registry.config.IPFSGateway, cid, []string{"manifests", target})
+	b, err := m.registry.readContent(cid, []string{"manifests", target})
+	if err != nil {
+		return nil, err
+	}
+	mf, err := decodeManifest(b)
 	if err != nil {
 		return nil, err
 	}
+	if isDigest(target) && mf.digest != target {
+		return nil, fmt.Errorf("digest mismatch: %s != %s", mf.digest, target)
+	}
+	return mf, nil
+}
+
+func decodeManifest(b []byte) (*manifest, error) {
 	mf, err := image.DecodeManifest(b)
 	if err != nil {
 		return nil, err
 	}
-	digest := computeDigest(b)
 	return &manifest{
 		blob:        b,
 		contentType: mf.MediaType,
-		digest:      digest,
+		digest:      computeDigest(b),
 	}, nil
 }
+
+// indexManifest records the size and media type of the manifest and of the content it references
+// in the blob index, along with the CID of the image directory holding them unless empty
+func (r *registry) indexManifest(cid string, b []byte) {
+	f, err := image.DecodeManifest(b)
+	if err != nil {
+		return
+	}
+	var cids []string
+	if cid != "" {
+		cids = []string{cid}
+	}
+	r.index.Add(computeDigest(b), &blobInfo{Size: int64(len(b)), MediaType: f.MediaType, CIDs: cids})
+	for _, d := range f.Descriptors() {
+		r.index.Add(d.Digest, &blobInfo{Size: d.Size, MediaType: d.MediaType, CIDs: cids})
+	}
+}
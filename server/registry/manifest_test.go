@@ -0,0 +1,438 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miguelmota/ipdr/server/registry/image"
+)
+
+func TestManifestDelete(t *testing.T) {
+	node := newFakeNode()
+	defer node.Close()
+
+	r, srv, done := newTestRegistry(t, &Config{
+		IPFSHost:      node.host(),
+		UnpinOnDelete: true,
+	})
+	defer done()
+
+	digest := computeDigest([]byte("manifest"))
+	r.cids.Add("app", "v1", "bafyimage")
+	r.cids.Add("app", "prod", "bafyimage")
+	r.cids.Add("app", digest, "bafyimage")
+
+	del := func(ref string) int {
+		req, _ := http.NewRequest("DELETE", srv.URL+"/v2/app/manifests/"+ref, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := del("v1"); status != http.StatusAccepted {
+		t.Fatalf("expected %d; got %d", http.StatusAccepted, status)
+	}
+	if _, ok := r.cids.Get("app", "v1"); ok {
+		t.Fatal("expected app:v1 to be removed")
+	}
+	if len(node.unpinned) != 0 {
+		t.Fatalf("expected no unpin while app:prod references the image; got %v", node.unpinned)
+	}
+
+	if status := del(digest); status != http.StatusAccepted {
+		t.Fatalf("expected %d; got %d", http.StatusAccepted, status)
+	}
+	if _, ok := r.cids.Get("app", "prod"); ok {
+		t.Fatal("expected app:prod to be removed along with the digest")
+	}
+	if len(node.unpinned) != 1 || node.unpinned[0] != "bafyimage" {
+		t.Fatalf("expected bafyimage to be unpinned; got %v", node.unpinned)
+	}
+
+	if status := del("v1"); status != http.StatusNotFound {
+		t.Fatalf("expected %d; got %d", http.StatusNotFound, status)
+	}
+
+	r.config.DisableDelete = true
+	r.cids.Add("app", "v2", "bafyimage")
+	if status := del("v2"); status != http.StatusMethodNotAllowed {
+		t.Fatalf("expected %d; got %d", http.StatusMethodNotAllowed, status)
+	}
+}
+
+func TestManifestDeleteAfterRestart(t *testing.T) {
+	node := newFakeNode()
+	defer node.Close()
+
+	r, srv, done := newTestRegistry(t, &Config{IPFSHost: node.host()})
+	defer done()
+
+	config := push(t, srv, "app", []byte(`{"os":"linux"}`))
+	mf, _ := json.Marshal(&image.Manifest{
+		SchemaVersion: 2,
+		MediaType:     image.ManifestType,
+		Config:        &image.Config{MediaType: image.ConfigType, Size: 14, Digest: config},
+	})
+	if resp := putManifest(t, srv, "app", "v1", image.ManifestType, mf); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d; got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	// digest references are gone after a restart, the tags and the blob index are left
+	restarted := newRegistry(r.config, Logger(log.New(ioutil.Discard, "", log.LstdFlags)))
+	defer restarted.Close()
+	srv2 := httptest.NewServer(http.HandlerFunc(restarted.root))
+	defer srv2.Close()
+
+	req, _ := http.NewRequest("DELETE", srv2.URL+"/v2/app/manifests/"+computeDigest(mf), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected %d; got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	if _, ok := restarted.cids.Get("app", "v1"); ok {
+		t.Fatal("expected app:v1 to be removed along with the digest")
+	}
+}
+
+func TestManifestAcceptOCI(t *testing.T) {
+	r, srv, done := newTestRegistry(t, nil)
+	defer done()
+
+	// mediaType is optional in OCI manifests
+	blob := []byte(`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","size":2,"digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+zstd","size":3,"digest":"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}]}`)
+	f, err := image.DecodeManifest(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.MediaType != image.OCIManifestType {
+		t.Fatalf("expected %s; got %s", image.OCIManifestType, f.MediaType)
+	}
+	r.manifests.manifests["app"] = map[string]*manifest{
+		"v1": {blob: blob, contentType: f.MediaType, digest: computeDigest(blob)},
+	}
+	r.cids.Add("app", "v1", "bafyimage")
+
+	get := func(accept ...string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/v2/app/manifests/v1", nil)
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get(image.ManifestType, image.ManifestListType); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d; got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	resp := get(image.ManifestType, image.OCIIndexType+", "+image.OCIManifestType+";q=0.9")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d; got %d", http.StatusOK, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != image.OCIManifestType {
+		t.Fatalf("expected content type %s; got %s", image.OCIManifestType, ct)
+	}
+	if _, ok := r.cids.Get("app", f.Layers[0].Digest); !ok {
+		t.Fatal("expected reverse lookup of the zstd layer")
+	}
+}
+
+func TestManifestVerified(t *testing.T) {
+	blob := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":2,"digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},"layers":[]}`)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(blob)
+	}))
+	defer gw.Close()
+
+	r, _, done := newTestRegistry(t, &Config{IPFSGateway: gw.URL})
+	defer done()
+
+	if _, err := r.manifests.getManifest("bafyimage", computeDigest(blob)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.manifests.getManifest("bafyimage", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.manifests.getManifest("bafyimage", computeDigest([]byte("other"))); err == nil {
+		t.Fatal("expected the digest mismatch to be rejected")
+	}
+}
+
+func TestMultiArchPush(t *testing.T) {
+	node := newFakeNode()
+	defer node.Close()
+
+	r, srv, done := newTestRegistry(t, &Config{IPFSHost: node.host(), UnpinOnDelete: true})
+	defer done()
+
+	var index struct {
+		SchemaVersion int                 `json:"schemaVersion"`
+		MediaType     string              `json:"mediaType"`
+		Manifests     []*image.Descriptor `json:"manifests"`
+	}
+	index.SchemaVersion = 2
+	index.MediaType = image.OCIIndexType
+
+	var expected, platforms []string
+	for _, arch := range []string{"amd64", "arm64"} {
+		config := push(t, srv, "app", []byte(`{"architecture":"`+arch+`"}`))
+		layer := push(t, srv, "app", []byte("layer "+arch))
+		mf, _ := json.Marshal(&image.Manifest{
+			SchemaVersion: 2,
+			MediaType:     image.OCIManifestType,
+			Config:        &image.Config{MediaType: image.OCIConfigType, Digest: config},
+			Layers:        []*image.Layer{{MediaType: image.OCILayerGzipType, Digest: layer}},
+		})
+		d := computeDigest(mf)
+		resp := putManifest(t, srv, "app", d, image.OCIManifestType, mf)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected %d; got %d", http.StatusCreated, resp.StatusCode)
+		}
+		// pullable on its own before the index is pushed
+		if resp.Header.Get("X-Docker-Content-ID") == "" {
+			t.Fatalf("expected platform manifest %s to be added to IPFS", d)
+		}
+		platforms = append(platforms, resp.Header.Get("X-Docker-Content-ID"))
+		index.Manifests = append(index.Manifests, &image.Descriptor{
+			MediaType: image.OCIManifestType,
+			Digest:    d,
+			Platform:  &image.Platform{Architecture: arch, OS: "linux"},
+		})
+		expected = append(expected, "blobs/"+config, "blobs/"+layer, "manifests/"+d)
+	}
+	b, _ := json.Marshal(index)
+	resp := putManifest(t, srv, "app", "v1", image.OCIIndexType, b)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d; got %d", http.StatusCreated, resp.StatusCode)
+	}
+	cid := resp.Header.Get("X-Docker-Content-ID")
+	expected = append(expected, "manifests/"+computeDigest(b), "manifests/latest", "manifests/v1")
+	sort.Strings(expected)
+	if paths := node.paths(cid); !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("expected a single CID directory with %v; got %v", expected, paths)
+	}
+
+	for _, desc := range index.Manifests {
+		if c, ok := r.cids.Get("app", desc.Digest); !ok || c != cid {
+			t.Fatalf("expected platform manifest %s to resolve to %s; got %s", desc.Digest, cid, c)
+		}
+	}
+	if c, _ := r.cids.Get("app", "v1"); c != cid {
+		t.Fatalf("expected app:v1 to resolve to %s; got %s", cid, c)
+	}
+
+	// the CIDs the platform manifests were pushed to go along with the index
+	node.lock.Lock()
+	node.unpinned = nil
+	node.lock.Unlock()
+	req, _ := http.NewRequest("DELETE", srv.URL+"/v2/app/manifests/v1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected %d; got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	unpinned := append([]string{}, node.unpinned...)
+	sort.Strings(unpinned)
+	expected = uniq(append([]string{cid}, platforms...))
+	sort.Strings(expected)
+	if !reflect.DeepEqual(unpinned, expected) {
+		t.Fatalf("expected %v to be unpinned; got %v", expected, unpinned)
+	}
+}
+
+func TestManifestPushByDigest(t *testing.T) {
+	node := newFakeNode()
+	defer node.Close()
+
+	r, srv, done := newTestRegistry(t, &Config{IPFSHost: node.host()})
+	defer done()
+
+	config := push(t, srv, "app", []byte(`{"architecture":"amd64"}`))
+	layer := push(t, srv, "app", []byte("layer"))
+	mf, _ := json.Marshal(&image.Manifest{
+		SchemaVersion: 2,
+		MediaType:     image.OCIManifestType,
+		Config:        &image.Config{MediaType: image.OCIConfigType, Digest: config},
+		Layers:        []*image.Layer{{MediaType: image.OCILayerGzipType, Digest: layer}},
+	})
+	d := computeDigest(mf)
+	resp := putManifest(t, srv, "app", d, image.OCIManifestType, mf)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d; got %d", http.StatusCreated, resp.StatusCode)
+	}
+	cid := resp.Header.Get("X-Docker-Content-ID")
+	expected := []string{"blobs/" + config, "blobs/" + layer, "manifests/" + d, "manifests/latest"}
+	sort.Strings(expected)
+	if paths := node.paths(cid); !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("expected %v; got %v", expected, paths)
+	}
+
+	for _, method := range []string{"HEAD", "GET"} {
+		req, _ := http.NewRequest(method, srv.URL+"/v2/app/manifests/"+d, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected %d; got %d", method, http.StatusOK, resp.StatusCode)
+		}
+		if method == "GET" && resp.Header.Get("X-Docker-Content-ID") != cid {
+			t.Fatalf("expected CID %s; got %s", cid, resp.Header.Get("X-Docker-Content-ID"))
+		}
+	}
+	if c, ok := r.cids.Get("app", d); !ok || c != cid {
+		t.Fatalf("expected %s to resolve to %s; got %s", d, cid, c)
+	}
+}
+
+func TestManifestCoalescing(t *testing.T) {
+	blob := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","layers":[]}`)
+	release := make(chan struct{})
+	var lock sync.Mutex
+	requests := map[string]int{}
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		requests[req.URL.Path]++
+		lock.Unlock()
+		if strings.HasPrefix(req.URL.Path, "/ipfs/bafyslow/") {
+			<-release
+		}
+		w.Write(blob)
+	}))
+	defer gw.Close()
+
+	r, srv, done := newTestRegistry(t, &Config{IPFSGateway: gw.URL})
+	defer done()
+	r.cids.Add("slow", "v1", "bafyslow")
+	r.cids.Add("fast", "v1", "bafyfast")
+
+	get := func(repo string) int {
+		resp, err := http.Get(srv.URL + "/v2/" + repo + "/manifests/v1")
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status := get("slow"); status != http.StatusOK {
+				t.Errorf("expected status 200; got %d", status)
+			}
+		}()
+	}
+
+	// an unrelated pull doesn't wait on the slow one
+	for {
+		lock.Lock()
+		n := requests["/ipfs/bafyslow/manifests/v1"]
+		lock.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if status := get("fast"); status != http.StatusOK {
+		t.Fatalf("expected status 200; got %d", status)
+	}
+
+	for r.manifests.flight.waiting(key("slow", "v1")) < 9 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if n := requests["/ipfs/bafyslow/manifests/v1"]; n != 1 {
+		t.Fatalf("expected one gateway request; got %d", n)
+	}
+}
+
+func TestRetagAndPromote(t *testing.T) {
+	node := newFakeNode()
+	defer node.Close()
+
+	_, srv, done := newTestRegistry(t, &Config{IPFSHost: node.host()})
+	defer done()
+
+	config := push(t, srv, "app", []byte(`{"architecture":"amd64"}`))
+	layer := push(t, srv, "app", []byte("app layer"))
+	mf, _ := json.Marshal(&image.Manifest{
+		SchemaVersion: 2,
+		MediaType:     image.OCIManifestType,
+		Config:        &image.Config{MediaType: image.OCIConfigType, Size: 24, Digest: config},
+		Layers:        []*image.Layer{{MediaType: image.OCILayerGzipType, Size: 9, Digest: layer}},
+	})
+	d := computeDigest(mf)
+	if resp := putManifest(t, srv, "app", d, image.OCIManifestType, mf); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d; got %d", http.StatusCreated, resp.StatusCode)
+	}
+	index, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     image.OCIIndexType,
+		"manifests":     []*image.Descriptor{{MediaType: image.OCIManifestType, Digest: d}},
+	})
+	resp := putManifest(t, srv, "app", "v1", image.OCIIndexType, index)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d; got %d", http.StatusCreated, resp.StatusCode)
+	}
+	v1 := resp.Header.Get("X-Docker-Content-ID")
+
+	// nothing is uploaded again, the blobs are linked from the CID of app:v1
+	for _, tc := range []struct {
+		repo, ref, contentType string
+		blob                   []byte
+	}{
+		{"app", "v2", image.OCIManifestType, mf},
+		{"prod/app", "v1", image.OCIManifestType, mf},
+		{"prod/app", "multi", image.OCIIndexType, index},
+	} {
+		resp := putManifest(t, srv, tc.repo, tc.ref, tc.contentType, tc.blob)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("%s:%s: expected %d; got %d", tc.repo, tc.ref, http.StatusCreated, resp.StatusCode)
+		}
+		cid := resp.Header.Get("X-Docker-Content-ID")
+		if cid == v1 {
+			t.Fatalf("%s:%s: expected a new CID", tc.repo, tc.ref)
+		}
+		if b := node.files[cid+"/blobs/"+layer]; string(b) != "app layer" {
+			t.Fatalf("%s:%s: expected the layer to be linked into %s; got %q", tc.repo, tc.ref, cid, b)
+		}
+	}
+
+	// blobs that are nowhere are still rejected
+	missing, _ := json.Marshal(&image.Manifest{
+		SchemaVersion: 2,
+		MediaType:     image.OCIManifestType,
+		Config:        &image.Config{MediaType: image.OCIConfigType, Size: 24, Digest: config},
+		Layers:        []*image.Layer{{MediaType: image.OCILayerGzipType, Size: 4, Digest: computeDigest([]byte("nope"))}},
+	})
+	if resp := putManifest(t, srv, "prod/app", "v2", image.OCIManifestType, missing); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d; got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
@@ -0,0 +1,141 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// policyRule grants subjects permissions on the repositories matching the globs.
+//
+//	{"subjects": ["team-a"], "repos": ["team-a/*"], "permissions": ["read", "write"]}
+type policyRule struct {
+	// Subjects are user or group names, * matches anyone including anonymous users
+	Subjects []string `json:"subjects"`
+	// Repos are globs as understood by path.Match, e.g. team-a/*, where * doesn't match /.
+	// A trailing /** matches any number of path elements, e.g. team-a/** matches team-a/app/api
+	Repos []string `json:"repos"`
+	// Permissions are read, write, delete or *
+	Permissions []string `json:"permissions"`
+}
+
+type policyFile struct {
+	// Groups maps group names to their users
+	Groups map[string][]string `json:"groups"`
+	Rules  []*policyRule       `json:"rules"`
+}
+
+// policy is the access policy of the repositories. The file is reloaded when it changes
+// and anything not granted by a rule is denied.
+type policy struct {
+	path    string
+	modTime time.Time
+	file    *policyFile
+
+	sync.Mutex
+}
+
+// permissions needed for the token actions
+var permissions = map[string]string{
+	"pull":   "read",
+	"push":   "write",
+	"delete": "delete",
+}
+
+func newPolicy(path string) *policy {
+	return &policy{
+		path: path,
+		file: &policyFile{},
+	}
+}
+
+// allows returns whether the user may perform the action (pull, push or delete) on the repo.
+// The previously loaded rules keep applying when the file can't be reloaded.
+func (p *policy) allows(user, repo, action string) (bool, error) {
+	p.Lock()
+	err := p.load()
+	f := p.file
+	p.Unlock()
+
+	perm, ok := permissions[action]
+	if !ok {
+		return false, err
+	}
+
+	subjects := map[string]bool{"*": true}
+	if user != "" {
+		subjects[user] = true
+		for group, users := range f.Groups {
+			for _, u := range users {
+				if u == user {
+					subjects[group] = true
+				}
+			}
+		}
+	}
+
+	for _, rule := range f.Rules {
+		if matchAny(rule.Subjects, func(s string) bool { return subjects[s] }) &&
+			matchAny(rule.Repos, func(glob string) bool { return matchRepo(glob, repo) }) &&
+			matchAny(rule.Permissions, func(p string) bool { return p == perm || p == "*" }) {
+			return true, err
+		}
+	}
+	return false, err
+}
+
+// load reads the file if it changed since it was last read
+func (p *policy) load() error {
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(p.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var f policyFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+
+	p.file = &f
+	p.modTime = fi.ModTime()
+	return nil
+}
+
+// matchRepo returns whether the repo matches the glob
+func matchRepo(glob, repo string) bool {
+	if !strings.HasSuffix(glob, "/**") {
+		ok, _ := path.Match(glob, repo)
+		return ok
+	}
+	// the leading elements match the rest of the glob, and at least one element follows
+	base := strings.TrimSuffix(glob, "/**")
+	for i := 0; i < len(repo); i++ {
+		if repo[i] != '/' {
+			continue
+		}
+		if ok, _ := path.Match(base, repo[:i]); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(list []string, match func(string) bool) bool {
+	for _, s := range list {
+		if match(s) {
+			return true
+		}
+	}
+	return false
+}
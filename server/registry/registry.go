@@ -24,12 +24,17 @@
 package registry
 
 import (
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/miguelmota/ipdr/ipfs"
 	"github.com/miguelmota/ipdr/regutil"
@@ -42,10 +47,70 @@ var contentTypes = map[string]string{
 
 // Config is the config for the registry
 type Config struct {
-	IPFSHost     string
-	IPFSGateway  string
+	IPFSHost string
+	// IPFSGateway is a gateway URL or a comma separated list of gateway URLs used with failover
+	IPFSGateway string
+	// GatewayTimeout is how long a gateway has to respond before the next one is tried.
+	// Defaults to 30 seconds
+	GatewayTimeout time.Duration
+	// GatewayRace is the number of gateways a request is sent to at once, the first response wins
+	GatewayRace  int
 	CIDResolvers []string
 	CIDStorePath string
+	// ResolverTTL is how long resolved DNSLink and IPNS roots are used before they are resolved again.
+	// Defaults to 5 minutes
+	ResolverTTL time.Duration
+	// ResolverNegativeTTL is how long a failed DNSLink or IPNS resolution is cached. Defaults to 30 seconds
+	ResolverNegativeTTL time.Duration
+	// ResolverToken is the bearer token sent to http(s) resolvers
+	ResolverToken string
+	// ResolverPrecedence is how the answers of the resolvers are combined, first (default) or agree
+	ResolverPrecedence string
+	// ResolverAuthority maps repo globs to the CID resolver whose answer wins for them
+	ResolverAuthority map[string]string
+	// BlobIndexPath is the location blob metadata is persisted to
+	BlobIndexPath string
+	// UploadDir is the scratch directory blob uploads are spooled to
+	UploadDir string
+	// UploadTTL is how long an idle upload session, or an uploaded blob no manifest push consumed,
+	// is kept before it expires. Defaults to one hour
+	UploadTTL time.Duration
+	// DisableDelete rejects manifest and tag deletion
+	DisableDelete bool
+	// UnpinOnDelete unpins the image CID on deletion once no tag references it
+	UnpinOnDelete bool
+	// AuthHtpasswd is the htpasswd file of the users allowed to log in.
+	// Token authentication is enabled when set
+	AuthHtpasswd string
+	// AuthKey is the key tokens are signed with. A random key is generated when empty
+	AuthKey []byte
+	// AuthRealm is the token endpoint advertised to clients. Defaults to the /token endpoint of the registry
+	AuthRealm string
+	// AuthService is the service tokens are issued for. Defaults to ipdr
+	AuthService string
+	// AuthTokenTTL is how long issued tokens are valid. Defaults to 15 minutes
+	AuthTokenTTL time.Duration
+	// Upstream is the Distribution registry images are mirrored from when they can't be resolved,
+	// e.g. https://registry-1.docker.io
+	Upstream string
+	// UpstreamTTL is how long a mirrored tag is served from IPFS before it's checked against upstream.
+	// Defaults to 5 minutes
+	UpstreamTTL time.Duration
+	// AuthPolicy is the access policy file granting users and groups access to repositories.
+	// Every user has full access when empty
+	AuthPolicy string
+	// ContentSource is where manifests and blobs are read from, gateway (default) or api.
+	// The other source is used when it fails
+	ContentSource string
+	// TrustlessGateway fetches content from the gateway as raw blocks verified against their CID,
+	// so that untrusted public gateways can be used
+	TrustlessGateway bool
+	// CacheDir is where blobs and manifests read from IPFS are cached by digest.
+	// Nothing is cached when empty
+	CacheDir string
+	// CacheSize is the size budget of the cache in bytes, the least recently used content is evicted
+	// above it. Defaults to 10GiB
+	CacheSize int64
 }
 
 type registry struct {
@@ -53,23 +118,47 @@ type registry struct {
 	blobs     blobs
 	manifests manifests
 
-	cids *cidStore
+	cids  *cidStore
+	index *blobIndex
+
+	// tokens is nil when authentication is disabled
+	tokens *tokenIssuer
+	users  *htpasswd
+	policy *policy
 
 	config     *Config
 	ipfsClient *ipfs.Client
+	gateways   *ipfs.GatewaySet
+
+	resolver  CIDResolver
+	resolving flightGroup
+	// trustless is nil unless content is fetched as verified raw blocks
+	trustless *trustlessGateway
+	// upstream is nil unless the registry is a pull-through cache
+	upstream *upstream
+	// cache is nil unless content read from IPFS is cached on disk
+	cache *diskCache
 
-	resolver CIDResolver
+	// closed to stop the expiry of uploads
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 // https://docs.docker.com/registry/spec/api/#api-version-check
 // https://github.com/opencontainers/distribution-spec/blob/master/spec.md#api-version-check
-func (r *registry) v2(resp http.ResponseWriter, req *http.Request) *regError {
+func (r *registry) v2(resp http.ResponseWriter, req *http.Request, user string) *regError {
+	if isCatalog(req) {
+		return r.catalog(resp, req, user)
+	}
 	if isBlob(req) {
 		return r.blobs.handle(resp, req)
 	}
 	if isManifest(req) {
 		return r.manifests.handle(resp, req)
 	}
+	if isTags(req) {
+		return r.tags(resp, req)
+	}
 	resp.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
 	if req.URL.Path != "/v2/" && req.URL.Path != "/v2" {
 		return &regError{
@@ -110,7 +199,17 @@ func (r *registry) dig(resp http.ResponseWriter, req *http.Request) {
 
 	if name == "" {
 		resp.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintln(resp, "Required parameter 'q' missing. /dig?q=name:tag&short=true")
+		fmt.Fprintln(resp, "Required parameter 'q' missing. /dig?q=name:tag&short=true&explain=true")
+		return
+	}
+
+	if parse(query.Get("explain")) {
+		if tag == "" {
+			tag = "latest"
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusOK)
+		json.NewEncoder(resp).Encode(r.explain(name, tag))
 		return
 	}
 
@@ -144,11 +243,33 @@ func (r *registry) dig(resp http.ResponseWriter, req *http.Request) {
 }
 
 func (r *registry) root(resp http.ResponseWriter, req *http.Request) {
+	if isToken(req) && r.tokens != nil {
+		if rerr := r.token(resp, req); rerr != nil {
+			r.log.Printf("%s %s %d %s %s", req.Method, req.URL.Path, rerr.Status, rerr.Code, rerr.Message)
+			rerr.Write(resp)
+			return
+		}
+		r.log.Printf("%s %s", req.Method, req.URL.Path)
+		return
+	}
+	user, rerr := r.authorize(resp, req)
+	if rerr == nil {
+		rerr = r.permit(user, req)
+	}
+	if rerr != nil {
+		r.log.Printf("%s %s %d %s %s", req.Method, req.URL, rerr.Status, rerr.Code, rerr.Message)
+		rerr.Write(resp)
+		return
+	}
 	if isDig(req) {
 		r.dig(resp, req)
 		return
 	}
-	if rerr := r.v2(resp, req); rerr != nil {
+	if isStatus(req) {
+		r.status(resp, req)
+		return
+	}
+	if rerr := r.v2(resp, req, user); rerr != nil {
 		r.log.Printf("%s %s %d %s %s", req.Method, req.URL, rerr.Status, rerr.Code, rerr.Message)
 		rerr.Write(resp)
 		return
@@ -156,11 +277,6 @@ func (r *registry) root(resp http.ResponseWriter, req *http.Request) {
 	r.log.Printf("%s %s", req.Method, req.URL)
 }
 
-// ipfsURL returns the full IPFS url
-func (r *registry) ipfsURL(s []string) string {
-	return regutil.IpfsURL(r.config.IPFSGateway, s)
-}
-
 // resolveCID returns content ID
 // Lookup cid by repo:reference (tag/digest) via external services
 // e.g. dnslink/ipns
@@ -168,8 +284,11 @@ func (r *registry) resolveCID(repo, reference string) (string, error) {
 	if reference == "" {
 		reference = "latest"
 	}
-	list := r.resolve(repo, reference)
-	if len(list) > 0 {
+	// concurrent lookups of the same repo:reference share one resolution
+	v, _ := r.resolving.do(key(repo, reference), func() (interface{}, error) {
+		return r.resolve(repo, reference), nil
+	})
+	if list := v.([]string); len(list) > 0 {
 		return list[0], nil
 	}
 	return "", fmt.Errorf("cannot resolve CID: %s:%s", repo, reference)
@@ -178,55 +297,236 @@ func (r *registry) resolveCID(repo, reference string) (string, error) {
 func (r *registry) resolve(repo, reference string) []string {
 	r.log.Printf("resolving CID: %s:%s", repo, reference)
 
+	if cid, ok := r.local(repo, reference); ok {
+		return []string{cid}
+	}
+
+	// lookup
+	return r.resolver.Resolve(repo, reference)
+}
+
+// restricted returns whether access control is enabled, with tokens or a policy
+func (r *registry) restricted() bool {
+	return r.tokens != nil || r.policy != nil
+}
+
+// local resolves repo:reference without the resolvers
+func (r *registry) local(repo, reference string) (string, bool) {
 	// local/cached
 	if cid, ok := r.cids.Get(repo, reference); ok {
-		return []string{cid}
+		return cid, true
 	}
-	// repo is a valid cid, ignore reference and assume "latest"
+	// repo is a valid cid, the reference selects a manifest inside it
+	return cidRepo(repo)
+}
+
+// cidRepo returns the CID of a repo named after an image directory, e.g. docker.local:5000/<cid>:<tag>
+func cidRepo(repo string) (string, bool) {
 	if cid := regutil.ToB32(repo); cid != "" {
-		return []string{cid}
+		return cid, true
 	}
 	if hash := regutil.IpfsifyHash(repo); hash != "" {
 		if cid := regutil.ToB32(hash); cid != "" {
-			return []string{cid}
+			return cid, true
 		}
 	}
+	return "", false
+}
 
-	// lookup
-	return r.resolver.Resolve(repo, reference)
+// explain returns the answers of the local store and of every resolver for repo:reference, and which one wins
+func (r *registry) explain(repo, reference string) *Explanation {
+	ex := &Explanation{
+		Repo:      repo,
+		Reference: reference,
+	}
+	if e, ok := r.resolver.(interface {
+		Explain(string, string) *Explanation
+	}); ok {
+		ex = e.Explain(repo, reference)
+	}
+
+	// the local store and CID repos take precedence over the resolvers, see resolve
+	cid, ok := r.local(repo, reference)
+	if !ok {
+		return ex
+	}
+	for i, a := range ex.Answers {
+		ex.Answers[i].Winner = false
+		if len(a.CIDs) > 0 && a.CIDs[0] != cid {
+			ex.Conflict = true
+		}
+	}
+	ex.Answers = append([]ResolverAnswer{{Source: "local", CIDs: []string{cid}, Winner: true}}, ex.Answers...)
+	ex.CID = cid
+	return ex
+}
+
+func isStatus(req *http.Request) bool {
+	return req.URL.Path == "/status"
+}
+
+type statusResponse struct {
+	Resolvers []ResolverStatus     `json:"resolvers"`
+	Gateways  []ipfs.GatewayStatus `json:"gateways"`
+	Cache     *CacheStats          `json:"cache,omitempty"`
+}
+
+// status returns the state of the resolvers, including the last resolved root and error, the health of the gateways
+// and the cache counters
+func (r *registry) status(resp http.ResponseWriter, req *http.Request) {
+	var st statusResponse
+	if s, ok := r.resolver.(interface{ Status() []ResolverStatus }); ok {
+		st.Resolvers = s.Status()
+	}
+	st.Gateways = r.gateways.Status()
+	if r.cache != nil {
+		stats := r.cache.Stats()
+		st.Cache = &stats
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	json.NewEncoder(resp).Encode(&st)
 }
 
 // New returns a handler which implements the docker registry protocol.
 // It should be registered at the site root.
+// The handler is an io.Closer, closing it stops its background work.
 func New(config *Config, opts ...Option) http.Handler {
+	return newRegistry(config, opts...)
+}
+
+func (r *registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	r.root(resp, req)
+}
+
+// Close stops the expiry of uploads
+func (r *registry) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+	})
+	return nil
+}
+
+func newRegistry(config *Config, opts ...Option) *registry {
 	ipfsClient := ipfs.NewRemoteClient(&ipfs.Config{
-		Host:       config.IPFSHost,
-		GatewayURL: config.IPFSGateway,
+		Host:           config.IPFSHost,
+		GatewayURL:     config.IPFSGateway,
+		GatewayTimeout: config.GatewayTimeout,
+		GatewayRace:    config.GatewayRace,
 	})
+	gateways := ipfsClient.Gateways()
+	if gateways == nil {
+		gateways = ipfs.NewGatewaySet(nil, nil)
+	}
+	uploadDir := config.UploadDir
+	if uploadDir == "" {
+		uploadDir = filepath.Join(os.TempDir(), "ipdr")
+	}
 	r := &registry{
-		log: log.New(os.Stderr, "", log.LstdFlags),
+		log:  log.New(os.Stderr, "", log.LstdFlags),
+		stop: make(chan struct{}),
 		blobs: blobs{
-			contents: map[string][]byte{},
-			uploads:  map[string][]byte{},
-			layers:   map[string][]string{},
+			contents: map[string]string{},
+			uploads:  map[string]*upload{},
+			mounts:   map[string]string{},
+			pending:  map[string]*pendingBlob{},
+			sizes:    map[string]int64{},
+			dir:      uploadDir,
 		},
 		manifests: manifests{
 			manifests: map[string]map[string]*manifest{},
 		},
 		cids:       newCIDStore(config.CIDStorePath),
+		index:      newBlobIndex(config.BlobIndexPath),
 		ipfsClient: ipfsClient,
+		gateways:   gateways,
 		config:     config,
 	}
 	// TODO refactor so we donot have to do this?
 	r.blobs.registry = r
 	r.manifests.registry = r
 
-	r.resolver = NewResolver(ipfsClient, config.CIDResolvers)
+	if config.TrustlessGateway {
+		r.trustless = &trustlessGateway{gateways: gateways}
+	}
+	if config.Upstream != "" {
+		ttl := config.UpstreamTTL
+		if ttl <= 0 {
+			ttl = 5 * time.Minute
+		}
+		r.upstream = newUpstream(r, config.Upstream, ttl)
+	}
+	if config.AuthPolicy != "" {
+		r.policy = newPolicy(config.AuthPolicy)
+	}
+	if config.AuthHtpasswd != "" {
+		r.users = newHtpasswd(config.AuthHtpasswd)
+		r.tokens = &tokenIssuer{
+			key:     config.AuthKey,
+			service: config.AuthService,
+			ttl:     config.AuthTokenTTL,
+		}
+		if r.tokens.service == "" {
+			r.tokens.service = "ipdr"
+		}
+		if r.tokens.ttl <= 0 {
+			r.tokens.ttl = 15 * time.Minute
+		}
+		if len(r.tokens.key) == 0 {
+			r.tokens.key = make([]byte, 32)
+			rand.Read(r.tokens.key)
+		}
+	}
 
 	for _, o := range opts {
 		o(r)
 	}
-	return http.HandlerFunc(r.root)
+
+	resolverTTL, negativeTTL := config.ResolverTTL, config.ResolverNegativeTTL
+	if resolverTTL <= 0 {
+		resolverTTL = 5 * time.Minute
+	}
+	if negativeTTL <= 0 {
+		negativeTTL = 30 * time.Second
+	}
+	r.resolver = NewResolver(ipfsClient, config.CIDResolvers, &ResolverOptions{
+		TTL:         resolverTTL,
+		NegativeTTL: negativeTTL,
+		Token:       config.ResolverToken,
+		Precedence:  config.ResolverPrecedence,
+		Authority:   config.ResolverAuthority,
+		Log:         r.log,
+	})
+
+	if config.CacheDir != "" {
+		size := config.CacheSize
+		if size <= 0 {
+			size = 10 << 30
+		}
+		cache, err := newDiskCache(config.CacheDir, size)
+		if err != nil {
+			r.log.Printf("cache %s disabled: %v", config.CacheDir, err)
+		}
+		r.cache = cache
+	}
+
+	ttl := config.UploadTTL
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	go func() {
+		ticker := time.NewTicker(ttl / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.blobs.expire(ttl)
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+	return r
 }
 
 // Option describes the available options
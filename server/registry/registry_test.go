@@ -0,0 +1,414 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestRegistry returns a registry served over http with its state in a temp directory.
+// Callers need to call the returned func when done.
+func newTestRegistry(t *testing.T, config *Config) (*registry, *httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "ipdr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config == nil {
+		config = &Config{}
+	}
+	if config.IPFSHost == "" {
+		config.IPFSHost = "127.0.0.1:5001"
+	}
+	if config.IPFSGateway == "" {
+		config.IPFSGateway = "http://127.0.0.1:8080"
+	}
+	config.CIDStorePath = filepath.Join(dir, "cids")
+	config.BlobIndexPath = filepath.Join(dir, "blobs")
+	config.UploadDir = filepath.Join(dir, "uploads")
+
+	r := newRegistry(config, Logger(log.New(ioutil.Discard, "", log.LstdFlags)))
+	srv := httptest.NewServer(http.HandlerFunc(r.root))
+
+	return r, srv, func() {
+		srv.Close()
+		r.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// fakeNode is a stand-in for the IPFS HTTP API that records the files added to it
+type fakeNode struct {
+	*httptest.Server
+	// maps <cid>/<path> -> content
+	files map[string][]byte
+	// maps IPNS name -> /ipfs/ path
+	names    map[string]string
+	pinned   []string
+	unpinned []string
+	lock     sync.Mutex
+}
+
+func newFakeNode() *fakeNode {
+	n := &fakeNode{
+		files: map[string][]byte{},
+		names: map[string]string{},
+	}
+	n.Server = httptest.NewServer(http.HandlerFunc(n.handle))
+	return n
+}
+
+// host returns the IPFS API host, e.g. 127.0.0.1:5001
+func (n *fakeNode) host() string {
+	return strings.TrimPrefix(n.URL, "http://")
+}
+
+func (n *fakeNode) handle(w http.ResponseWriter, req *http.Request) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	switch req.URL.Path {
+	case "/api/v0/add":
+		_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		added := map[string][]byte{}
+		h := sha256.New()
+		mr := multipart.NewReader(req.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			if part.Header.Get("Content-Type") != "application/octet-stream" {
+				continue
+			}
+			name, _ := url.QueryUnescape(part.FileName())
+			b, _ := ioutil.ReadAll(part)
+			added[name] = b
+			h.Write([]byte(name))
+			h.Write(b)
+		}
+		// every file is added under the single top level directory
+		cid := "bafy" + hex.EncodeToString(h.Sum(nil))[:16]
+		for name, b := range added {
+			n.files[cid+"/"+strings.SplitN(name, "/", 2)[1]] = b
+		}
+		json.NewEncoder(w).Encode(map[string]string{"Hash": cid})
+	case "/api/v0/resolve":
+		p := strings.TrimPrefix(req.URL.Query().Get("arg"), "/ipfs/")
+		b, ok := n.files[p]
+		if !ok {
+			http.Error(w, `{"Message":"no link named"}`, http.StatusInternalServerError)
+			return
+		}
+		// blocks are addressed by their content
+		hash := "bafyblock" + computeDigest(b)[7:23]
+		n.files[hash] = b
+		json.NewEncoder(w).Encode(map[string]string{"Path": "/ipfs/" + hash})
+	case "/api/v0/object/patch/add-link":
+		args := req.URL.Query()["arg"]
+		root, name, ref := args[0], args[1], args[2]
+		newRoot := "bafypatched" + computeDigest([]byte(root + name + ref))[7:23]
+		for k, b := range n.files {
+			if strings.HasPrefix(k, root+"/") {
+				n.files[newRoot+strings.TrimPrefix(k, root)] = b
+			}
+		}
+		n.files[newRoot+"/"+name] = n.files[ref]
+		json.NewEncoder(w).Encode(map[string]string{"Hash": newRoot})
+	case "/api/v0/cat":
+		b, ok := n.files[strings.TrimPrefix(req.URL.Query().Get("arg"), "/ipfs/")]
+		if !ok {
+			http.Error(w, `{"Message":"no link named"}`, http.StatusInternalServerError)
+			return
+		}
+		if offset, err := strconv.Atoi(req.URL.Query().Get("offset")); err == nil && offset <= len(b) {
+			b = b[offset:]
+		}
+		if length, err := strconv.Atoi(req.URL.Query().Get("length")); err == nil && length < len(b) {
+			b = b[:length]
+		}
+		w.Write(b)
+	case "/api/v0/files/stat":
+		b, ok := n.files[strings.TrimPrefix(req.URL.Query().Get("arg"), "/ipfs/")]
+		if !ok {
+			http.Error(w, `{"Message":"no link named"}`, http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Size": len(b), "Type": "file"})
+	case "/api/v0/ls":
+		dir := strings.TrimPrefix(req.URL.Query().Get("arg"), "/ipfs/") + "/"
+		links := []map[string]interface{}{}
+		seen := map[string]bool{}
+		for k, b := range n.files {
+			if !strings.HasPrefix(k, dir) {
+				continue
+			}
+			// files of subdirectories are listed as their directory
+			name, typ := strings.TrimPrefix(k, dir), 2
+			if i := strings.Index(name, "/"); i >= 0 {
+				name, typ = name[:i], 1
+			}
+			if !seen[name] {
+				seen[name] = true
+				links = append(links, map[string]interface{}{"Name": name, "Size": len(b), "Type": typ})
+			}
+		}
+		if len(links) == 0 {
+			http.Error(w, `{"Message":"no link named"}`, http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Objects": []interface{}{map[string]interface{}{"Links": links}}})
+	case "/api/v0/name/resolve":
+		p, ok := n.names[req.URL.Query().Get("arg")]
+		if !ok {
+			http.Error(w, `{"Message":"could not resolve name"}`, http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"Path": p})
+	case "/api/v0/pin/add":
+		n.pinned = append(n.pinned, req.URL.Query().Get("arg"))
+		w.Write([]byte("{}"))
+	case "/api/v0/pin/rm":
+		n.unpinned = append(n.unpinned, req.URL.Query().Get("arg"))
+		w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// paths returns the sorted paths of the files under cid
+func (n *fakeNode) paths(cid string) []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	var list []string
+	for k := range n.files {
+		if strings.HasPrefix(k, cid+"/") {
+			list = append(list, strings.TrimPrefix(k, cid+"/"))
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// push uploads the blob monolithically
+func push(t *testing.T, srv *httptest.Server, repo string, blob []byte) string {
+	digest := computeDigest(blob)
+	resp, err := http.Post(srv.URL+"/v2/"+repo+"/blobs/uploads/?digest="+digest, "", bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d; got %d", http.StatusCreated, resp.StatusCode)
+	}
+	return digest
+}
+
+// putManifest uploads the manifest and returns the response
+func putManifest(t *testing.T, srv *httptest.Server, repo, ref, contentType string, blob []byte) *http.Response {
+	req, _ := http.NewRequest("PUT", srv.URL+"/v2/"+repo+"/manifests/"+ref, bytes.NewReader(blob))
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestTagsList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipdr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tag := range []string{"v1", "v2"} {
+		p := filepath.Join(dir, "team/app", tag)
+		os.MkdirAll(filepath.Dir(p), os.ModePerm)
+		ioutil.WriteFile(p, []byte("bafyresolved"), 0644)
+	}
+
+	r, srv, done := newTestRegistry(t, &Config{CIDResolvers: []string{"file:" + dir}})
+	defer done()
+	r.cids.Add("team/app", "latest", "bafylatest")
+	r.cids.Add("team/app", "v1", "bafyresolved")
+	r.cids.Add("team/app", computeDigest([]byte("manifest")), "bafylatest")
+
+	get := func(uri string) (*http.Response, tagsResponse) {
+		resp, err := http.Get(srv.URL + uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var tr tagsResponse
+		json.NewDecoder(resp.Body).Decode(&tr)
+		return resp, tr
+	}
+
+	resp, tr := get("/v2/team/app/tags/list")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d; got %d", http.StatusOK, resp.StatusCode)
+	}
+	if expected := []string{"latest", "v1", "v2"}; tr.Name != "team/app" || !reflect.DeepEqual(tr.Tags, expected) {
+		t.Fatalf("expected team/app %v; got %s %v", expected, tr.Name, tr.Tags)
+	}
+
+	resp, tr = get("/v2/team/app/tags/list?n=2")
+	if expected := []string{"latest", "v1"}; !reflect.DeepEqual(tr.Tags, expected) {
+		t.Fatalf("expected %v; got %v", expected, tr.Tags)
+	}
+	if link := resp.Header.Get("Link"); link != `</v2/team/app/tags/list?last=v1&n=2>; rel="next"` {
+		t.Fatalf("unexpected link header %s", link)
+	}
+
+	resp, tr = get("/v2/team/app/tags/list?n=2&last=v1")
+	if expected := []string{"v2"}; !reflect.DeepEqual(tr.Tags, expected) {
+		t.Fatalf("expected %v; got %v", expected, tr.Tags)
+	}
+	if link := resp.Header.Get("Link"); link != "" {
+		t.Fatalf("expected no link header on the last page; got %s", link)
+	}
+
+	resp, _ = get("/v2/unknown/tags/list")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d; got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestCIDRepoTags(t *testing.T) {
+	node := newFakeNode()
+	defer node.Close()
+	v1 := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","layers":[]}`)
+	v2 := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`)
+	// one image directory bundling two tags
+	cid := "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"
+	for ref, b := range map[string][]byte{"latest": v1, "v1": v1, computeDigest(v1): v1, "v2": v2, computeDigest(v2): v2} {
+		node.files[cid+"/manifests/"+ref] = b
+	}
+
+	_, srv, done := newTestRegistry(t, &Config{IPFSHost: node.host(), IPFSGateway: "http://127.0.0.1:1", ContentSource: ContentAPI})
+	defer done()
+
+	get := func(uri string) (int, []byte) {
+		resp, err := http.Get(srv.URL + uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, b
+	}
+
+	for ref, expected := range map[string][]byte{"latest": v1, "v1": v1, "v2": v2, computeDigest(v1): v1, computeDigest(v2): v2} {
+		if status, b := get("/v2/" + cid + "/manifests/" + ref); status != http.StatusOK || !bytes.Equal(b, expected) {
+			t.Fatalf("%s: expected %s; got %d %s", ref, expected, status, b)
+		}
+	}
+	if status, _ := get("/v2/" + cid + "/manifests/v3"); status != http.StatusNotFound {
+		t.Fatalf("expected %d for a tag missing from the CID; got %d", http.StatusNotFound, status)
+	}
+
+	status, b := get("/v2/" + cid + "/tags/list")
+	var tr tagsResponse
+	json.Unmarshal(b, &tr)
+	if expected := []string{"latest", "v1", "v2"}; status != http.StatusOK || !reflect.DeepEqual(tr.Tags, expected) {
+		t.Fatalf("expected %v; got %d %v", expected, status, tr.Tags)
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipdr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, repo := range []string{"team/app/api", "team/app", "web"} {
+		p := filepath.Join(dir, repo, "latest")
+		os.MkdirAll(filepath.Dir(p), os.ModePerm)
+		ioutil.WriteFile(p, []byte("bafyresolved"), 0644)
+	}
+
+	r, srv, done := newTestRegistry(t, &Config{CIDResolvers: []string{"file:" + dir}})
+	defer done()
+	r.cids.Add("local", "latest", "bafylocal")
+	r.cids.Add("bafylocal", computeDigest([]byte("{}")), "bafylocal")
+
+	resp, err := http.Get(srv.URL + "/v2/_catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cr catalogResponse
+	json.NewDecoder(resp.Body).Decode(&cr)
+	resp.Body.Close()
+	if expected := []string{"local", "team/app", "team/app/api", "web"}; !reflect.DeepEqual(cr.Repositories, expected) {
+		t.Fatalf("expected %v; got %v", expected, cr.Repositories)
+	}
+
+	resp, err = http.Get(srv.URL + "/v2/_catalog?n=2&last=local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&cr)
+	resp.Body.Close()
+	if expected := []string{"team/app", "team/app/api"}; !reflect.DeepEqual(cr.Repositories, expected) {
+		t.Fatalf("expected %v; got %v", expected, cr.Repositories)
+	}
+	if link := resp.Header.Get("Link"); link != `</v2/_catalog?last=team%2Fapp%2Fapi&n=2>; rel="next"` {
+		t.Fatalf("unexpected link header %s", link)
+	}
+}
+
+func TestDigExplain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipdr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "app"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(dir, "app", "prod"), []byte("bafyresolved"), 0644)
+
+	r, srv, done := newTestRegistry(t, &Config{CIDResolvers: []string{"file:" + dir}})
+	defer done()
+
+	explain := func() *Explanation {
+		resp, err := http.Get(srv.URL + "/dig?q=app:prod&explain=true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var ex Explanation
+		json.NewDecoder(resp.Body).Decode(&ex)
+		return &ex
+	}
+
+	ex := explain()
+	if ex.CID != "bafyresolved" || ex.Conflict || len(ex.Answers) != 1 || !ex.Answers[0].Winner {
+		t.Fatalf("expected the file resolver to win; got %+v", ex)
+	}
+
+	r.cids.Add("app", "prod", "bafylocal")
+	ex = explain()
+	if ex.CID != "bafylocal" || !ex.Conflict || len(ex.Answers) != 2 || ex.Answers[0].Source != "local" || ex.Answers[1].Winner {
+		t.Fatalf("expected the local store to win over the conflicting resolver; got %+v", ex)
+	}
+}
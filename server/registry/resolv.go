@@ -3,11 +3,17 @@ package registry
 import (
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
+	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	api "github.com/ipfs/go-ipfs-api"
 	"github.com/miguelmota/ipdr/ipfs"
 )
 
@@ -71,40 +77,211 @@ func (r *fileResolver) Resolve(repo, reference string) []string {
 	return nil
 }
 
-// DNSLink resolver
-// https://docs.ipfs.io/concepts/dnslink/
-type dnslinkResolver struct {
-	resolver CIDResolver
+func (r *fileResolver) Repos() []string {
+	return walkRepos(r.root)
 }
 
-func NewDNSLinkResolver(client *ipfs.Client, domain string) (CIDResolver, error) {
-	var r CIDResolver
-	txt, err := lookup(domain)
-	if err != nil {
-		return nil, err
+func (r *fileResolver) Status() ResolverStatus {
+	st := ResolverStatus{
+		Source: "file:" + r.root,
+		Root:   "file:" + r.root,
 	}
-	switch {
-	case strings.HasPrefix(txt, "file:"):
-		r, err = NewFileResolver(txt)
-		if err != nil {
-			return nil, err
+	if _, err := os.Stat(r.root); err != nil {
+		st.Error = err.Error()
+	}
+	return st
+}
+
+// walkRepos returns the nested directories under root that contain reference files, e.g. team/app/api
+func walkRepos(root string) []string {
+	var list []string
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
 		}
-	case strings.HasPrefix(txt, "/ipfs/"):
-		r, err = NewIPFSResolver(client, txt)
-		if err != nil {
-			return nil, err
+		if rel, err := filepath.Rel(root, filepath.Dir(p)); err == nil && rel != "." {
+			list = append(list, filepath.ToSlash(rel))
 		}
-	default:
-		return nil, fmt.Errorf("not supported: %s", txt)
+		return nil
+	})
+	return uniq(list)
+}
+
+// ResolverStatus is the state of a resolver root
+type ResolverStatus struct {
+	Source string `json:"source"`
+	// Root is the last successfully resolved root, e.g. /ipfs/<cid>
+	Root       string    `json:"root,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ResolvedAt time.Time `json:"resolved_at,omitempty"`
+	CheckedAt  time.Time `json:"checked_at,omitempty"`
+}
+
+// liveResolver re-resolves its root once the TTL expires so that updates of DNSLink records
+// and IPNS names are picked up without restarting the server.
+// Failures are cached for the negative TTL and the last resolved root keeps being used meanwhile.
+type liveResolver struct {
+	source      string
+	resolveRoot func() (CIDResolver, string, error)
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	current  CIDResolver
+	root     string
+	err      error
+	resolved time.Time
+	checked  time.Time
+	// set while the root is being resolved, readers keep using the current root meanwhile
+	refreshing bool
+	// concurrent resolutions of the root share one, the lock is never held across it
+	flight flightGroup
+
+	sync.Mutex
+}
+
+// get returns the resolver of the current root, refreshing it when expired
+func (r *liveResolver) get() CIDResolver {
+	r.Lock()
+	ttl := r.ttl
+	if r.err != nil {
+		ttl = r.negativeTTL
+	}
+	if (!r.checked.IsZero() && time.Since(r.checked) < ttl) || (r.refreshing && r.current != nil) {
+		current := r.current
+		r.Unlock()
+		return current
+	}
+	r.refreshing = true
+	r.Unlock()
+
+	r.flight.do(r.source, func() (interface{}, error) {
+		current, root, err := r.resolveRoot()
+
+		r.Lock()
+		defer r.Unlock()
+		r.checked = time.Now()
+		r.err = err
+		if err == nil {
+			r.current = current
+			r.root = root
+			r.resolved = r.checked
+		}
+		r.refreshing = false
+		return nil, nil
+	})
+
+	r.Lock()
+	defer r.Unlock()
+	return r.current
+}
+
+func (r *liveResolver) Resolve(repo, reference string) []string {
+	if current := r.get(); current != nil {
+		return current.Resolve(repo, reference)
+	}
+	return nil
+}
+
+func (r *liveResolver) Repos() []string {
+	if l, ok := r.get().(RepoLister); ok {
+		return l.Repos()
 	}
+	return nil
+}
+
+func (r *liveResolver) Status() ResolverStatus {
+	r.get()
+
+	r.Lock()
+	defer r.Unlock()
+	st := ResolverStatus{
+		Source:     r.source,
+		Root:       r.root,
+		ResolvedAt: r.resolved,
+		CheckedAt:  r.checked,
+	}
+	if r.err != nil {
+		st.Error = r.err.Error()
+	}
+	return st
+}
+
+// ResolverOptions configures the resolvers
+type ResolverOptions struct {
+	// TTL is how long resolved DNSLink and IPNS roots are used before they are resolved again
+	TTL time.Duration
+	// NegativeTTL is how long a failed DNSLink or IPNS resolution is cached
+	NegativeTTL time.Duration
+	// Token is the bearer token sent to http(s) resolvers
+	Token string
+	// Precedence is how the answers of the resolvers are combined, PrecedenceFirst by default
+	Precedence string
+	// Authority maps repo globs, e.g. team/*, to the resolver, as given in the list, whose answer wins for them
+	Authority map[string]string
+	// Log records the resolvers of the list that can't be created
+	// and conflicting answers of lookups asking every resolver. Discarded when nil
+	Log *log.Logger
+}
+
+const (
+	// PrecedenceFirst uses the answer of the first resolver of the list that has one
+	PrecedenceFirst = "first"
+	// PrecedenceAgree requires every resolver that has an answer to agree
+	PrecedenceAgree = "agree"
+)
 
-	return &dnslinkResolver{
-		resolver: r,
+// DNSLink resolver
+// https://docs.ipfs.io/concepts/dnslink/
+func NewDNSLinkResolver(client *ipfs.Client, domain string, opts *ResolverOptions) (CIDResolver, error) {
+	return &liveResolver{
+		source: domain,
+		resolveRoot: func() (CIDResolver, string, error) {
+			txt, err := lookup(domain)
+			if err != nil {
+				return nil, "", err
+			}
+			switch {
+			case strings.HasPrefix(txt, "file:"):
+				r, err := NewFileResolver(txt)
+				return r, txt, err
+			case strings.HasPrefix(txt, "/ipfs/"):
+				r, err := NewIPFSResolver(client, txt)
+				return r, txt, err
+			case strings.HasPrefix(txt, "/ipns/"):
+				return resolveIPNS(client, txt)
+			case strings.HasPrefix(txt, "http://"), strings.HasPrefix(txt, "https://"):
+				r, err := NewHTTPResolver(txt, opts.Token)
+				return r, txt, err
+			default:
+				return nil, "", fmt.Errorf("not supported: %s", txt)
+			}
+		},
+		ttl:         opts.TTL,
+		negativeTTL: opts.NegativeTTL,
 	}, nil
 }
 
-func (r *dnslinkResolver) Resolve(repo, reference string) []string {
-	return r.resolver.Resolve(repo, reference)
+// IPNS resolver
+// https://docs.ipfs.io/concepts/ipns/
+func NewIPNSResolver(client *ipfs.Client, name string, opts *ResolverOptions) (CIDResolver, error) {
+	return &liveResolver{
+		source: name,
+		resolveRoot: func() (CIDResolver, string, error) {
+			return resolveIPNS(client, name)
+		},
+		ttl:         opts.TTL,
+		negativeTTL: opts.NegativeTTL,
+	}, nil
+}
+
+// resolveIPNS returns the IPFS resolver of the path the name points to
+func resolveIPNS(client *ipfs.Client, name string) (CIDResolver, string, error) {
+	p, err := client.ResolveName(name)
+	if err != nil {
+		return nil, "", err
+	}
+	r, err := NewIPFSResolver(client, p)
+	return r, p, err
 }
 
 // IPFS resolver
@@ -139,6 +316,37 @@ func (r *ipfsResolver) Resolve(repo string, reference string) []string {
 	return nil
 }
 
+// Repos walks the directories under the root that contain reference files
+func (r *ipfsResolver) Repos() []string {
+	var list []string
+	var walk func(repo string)
+	walk = func(repo string) {
+		links, err := r.client.List(path.Join(r.cid, repo))
+		if err != nil {
+			return
+		}
+		for _, l := range links {
+			switch l.Type {
+			case api.TFile:
+				if repo != "" {
+					list = append(list, repo)
+				}
+			case api.TDirectory:
+				walk(path.Join(repo, l.Name))
+			}
+		}
+	}
+	walk("")
+	return uniq(list)
+}
+
+func (r *ipfsResolver) Status() ResolverStatus {
+	return ResolverStatus{
+		Source: "/ipfs/" + r.cid,
+		Root:   "/ipfs/" + r.cid,
+	}
+}
+
 func (r *ipfsResolver) getContent(repo, reference string) ([]byte, error) {
 	rd, err := r.client.Cat(fmt.Sprintf("%s/%s/%s", r.cid, repo, reference))
 	if err != nil {
@@ -150,50 +358,209 @@ func (r *ipfsResolver) getContent(repo, reference string) ([]byte, error) {
 
 type resolver struct {
 	resolvers []CIDResolver
+	// sources are the list entries of the resolvers
+	sources    []string
+	precedence string
+	authority  map[string]string
+	log        *log.Logger
+}
+
+// ResolverAnswer is the answer of a resolver to a repo:reference lookup
+type ResolverAnswer struct {
+	Source string   `json:"source"`
+	CIDs   []string `json:"cids"`
+	Winner bool     `json:"winner,omitempty"`
+}
+
+// Explanation describes how a repo:reference lookup was resolved
+type Explanation struct {
+	Repo       string           `json:"repo"`
+	Reference  string           `json:"reference"`
+	Precedence string           `json:"precedence"`
+	Answers    []ResolverAnswer `json:"answers"`
+	// CID is the winning answer, empty when unresolved
+	CID string `json:"cid,omitempty"`
+	// Conflict is set when resolvers disagree
+	Conflict bool   `json:"conflict,omitempty"`
+	Reason   string `json:"reason,omitempty"`
 }
 
-func NewResolver(client *ipfs.Client, list []string) CIDResolver {
+// NewResolver returns a resolver combining the resolvers of the list.
+func NewResolver(client *ipfs.Client, list []string, opts *ResolverOptions) CIDResolver {
+	if opts == nil {
+		opts = &ResolverOptions{}
+	}
+	logger := opts.Log
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
 	var resolvers []CIDResolver
+	var sources []string
 	for _, l := range list {
+		var r CIDResolver
+		var err error
 		switch {
 		case strings.HasPrefix(l, "file:"):
-			if r, err := NewFileResolver(l); err == nil {
-				resolvers = append(resolvers, r)
-			}
+			r, err = NewFileResolver(l)
 		case strings.HasPrefix(l, "/ipfs/"):
-			if r, err := NewIPFSResolver(client, l); err == nil {
-				resolvers = append(resolvers, r)
-			}
+			r, err = NewIPFSResolver(client, l)
+		case strings.HasPrefix(l, "/ipns/"):
+			r, err = NewIPNSResolver(client, l, opts)
+		case strings.HasPrefix(l, "http://"), strings.HasPrefix(l, "https://"):
+			r, err = NewHTTPResolver(l, opts.Token)
 		default:
 			// assume dnslink
-			if r, err := NewDNSLinkResolver(client, l); err == nil {
-				resolvers = append(resolvers, r)
-			}
+			r, err = NewDNSLinkResolver(client, l, opts)
+		}
+		if err != nil {
+			logger.Printf("cid resolver %s skipped: %v", l, err)
+			continue
 		}
+		resolvers = append(resolvers, r)
+		sources = append(sources, l)
 	}
 
+	precedence := opts.Precedence
+	if precedence == "" {
+		precedence = PrecedenceFirst
+	}
 	return &resolver{
-		resolvers: resolvers,
+		resolvers:  resolvers,
+		sources:    sources,
+		precedence: precedence,
+		authority:  opts.Authority,
+		log:        logger,
 	}
 }
 
-// collect all results if reference is empty for listing
-func (r *resolver) Resolve(repo string, reference string) []string {
+// Status returns the status of every resolver
+func (r *resolver) Status() []ResolverStatus {
+	var list []ResolverStatus
+	for _, re := range r.resolvers {
+		if s, ok := re.(interface{ Status() ResolverStatus }); ok {
+			list = append(list, s.Status())
+		}
+	}
+	return list
+}
+
+// Repos returns the union of the repositories of every resolver that can list them
+func (r *resolver) Repos() []string {
 	var list []string
 	for _, re := range r.resolvers {
-		if result := re.Resolve(repo, reference); result != nil {
-			// return early
-			if reference != "" {
-				return result
+		if l, ok := re.(RepoLister); ok {
+			list = append(list, l.Repos()...)
+		}
+	}
+	list = uniq(list)
+	sort.Strings(list)
+	return list
+}
+
+// collect all results if reference is empty for listing
+func (r *resolver) Resolve(repo string, reference string) []string {
+	if _, ok := r.authoritative(repo); reference != "" && !ok && r.precedence == PrecedenceFirst {
+		// the first answer wins, the other resolvers need not be asked
+		for _, re := range r.resolvers {
+			if cids := re.Resolve(repo, reference); len(cids) > 0 {
+				return cids
 			}
-			list = append(list, result...)
 		}
+		return nil
+	}
+	if reference != "" {
+		ex := r.Explain(repo, reference)
+		if ex.Conflict {
+			r.log.Printf("conflicting CIDs for %s:%s, %s", repo, reference, ex.Reason)
+		}
+		for _, a := range ex.Answers {
+			if a.Winner {
+				return a.CIDs
+			}
+		}
+		return nil
+	}
+
+	var list []string
+	for _, re := range r.resolvers {
+		list = append(list, re.Resolve(repo, "")...)
 	}
 	list = uniq(list)
 	sort.Strings(list)
 	return list
 }
 
+// Explain asks every resolver for the reference and picks the winning answer
+func (r *resolver) Explain(repo, reference string) *Explanation {
+	ex := &Explanation{
+		Repo:       repo,
+		Reference:  reference,
+		Precedence: r.precedence,
+	}
+	for i, re := range r.resolvers {
+		ex.Answers = append(ex.Answers, ResolverAnswer{
+			Source: r.sources[i],
+			CIDs:   re.Resolve(repo, reference),
+		})
+	}
+
+	// distinct answers in the order of the list
+	var cids []string
+	for _, a := range ex.Answers {
+		if len(a.CIDs) > 0 {
+			cids = append(cids, a.CIDs[0])
+		}
+	}
+	cids = uniq(cids)
+	ex.Conflict = len(cids) > 1
+	if ex.Conflict {
+		var sa []string
+		for _, a := range ex.Answers {
+			if len(a.CIDs) > 0 {
+				sa = append(sa, a.Source+"="+a.CIDs[0])
+			}
+		}
+		ex.Reason = strings.Join(sa, " ")
+	}
+
+	winner := -1
+	if source, ok := r.authoritative(repo); ok {
+		ex.Precedence = "authority " + source
+		for i, a := range ex.Answers {
+			if a.Source == source && len(a.CIDs) > 0 {
+				winner = i
+			}
+		}
+	} else {
+		for i, a := range ex.Answers {
+			if len(a.CIDs) > 0 {
+				winner = i
+				break
+			}
+		}
+		if r.precedence == PrecedenceAgree && ex.Conflict {
+			winner = -1
+		}
+	}
+	if winner >= 0 {
+		ex.Answers[winner].Winner = true
+		ex.CID = ex.Answers[winner].CIDs[0]
+	}
+	return ex
+}
+
+// authoritative returns the resolver source that is authoritative for the repo.
+// The longest matching glob wins.
+func (r *resolver) authoritative(repo string) (string, bool) {
+	var source, glob string
+	for g, s := range r.authority {
+		if ok, _ := path.Match(g, repo); ok && (len(g) > len(glob) || len(g) == len(glob) && g < glob) {
+			source, glob = s, g
+		}
+	}
+	return source, glob != ""
+}
+
 func uniq(sa []string) []string {
 	keys := make(map[string]bool)
 	list := []string{}
@@ -0,0 +1,359 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miguelmota/ipdr/ipfs"
+)
+
+func TestLiveResolverRefresh(t *testing.T) {
+	var calls int
+	var err error
+	root := "file:/a"
+	r := &liveResolver{
+		source: "example.com",
+		resolveRoot: func() (CIDResolver, string, error) {
+			calls++
+			if err != nil {
+				return nil, "", err
+			}
+			fr, _ := NewFileResolver(root)
+			return fr, root, nil
+		},
+		ttl:         time.Hour,
+		negativeTTL: time.Hour,
+	}
+
+	r.get()
+	r.get()
+	if calls != 1 {
+		t.Fatalf("expected the root to be cached; got %d resolutions", calls)
+	}
+
+	// expired, failing
+	r.checked = time.Now().Add(-2 * time.Hour)
+	err = errors.New("no such host")
+	root = "file:/b"
+	if r.get() == nil {
+		t.Fatal("expected the last resolved root to be kept")
+	}
+	r.get()
+	if calls != 2 {
+		t.Fatalf("expected the failure to be cached; got %d resolutions", calls)
+	}
+	st := r.Status()
+	if st.Root != "file:/a" || st.Error != "no such host" {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	// negative cache expired, recovered
+	r.checked = time.Now().Add(-2 * time.Hour)
+	err = nil
+	r.get()
+	if st := r.Status(); st.Root != "file:/b" || st.Error != "" {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestLiveResolverStale(t *testing.T) {
+	release := make(chan struct{})
+	var calls int32
+	r := &liveResolver{
+		source: "example.com",
+		resolveRoot: func() (CIDResolver, string, error) {
+			if atomic.AddInt32(&calls, 1) > 1 {
+				<-release
+			}
+			fr, _ := NewFileResolver("file:/a")
+			return fr, "file:/a", nil
+		},
+		ttl:         time.Hour,
+		negativeTTL: time.Hour,
+	}
+	stale := r.get()
+
+	// expired, the refresh blocks but readers keep getting the current root
+	r.Lock()
+	r.checked = time.Now().Add(-2 * time.Hour)
+	r.Unlock()
+	refreshed := make(chan struct{})
+	go func() {
+		r.get()
+		close(refreshed)
+	}()
+	for atomic.LoadInt32(&calls) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		if r.get() != stale {
+			t.Fatal("expected the stale root while refreshing")
+		}
+	}
+	close(release)
+	<-refreshed
+	if calls != 2 {
+		t.Fatalf("expected a single refresh; got %d resolutions", calls-1)
+	}
+}
+
+func TestIPNSResolver(t *testing.T) {
+	node := newFakeNode()
+	defer node.Close()
+	node.names["k51key"] = "/ipfs/bafyroot1"
+	node.files["bafyroot1/app/v1"] = []byte("bafyimage1\n")
+	node.files["bafyroot2/app/v1"] = []byte("bafyimage2\n")
+
+	client := ipfs.NewRemoteClient(&ipfs.Config{Host: node.host()})
+	r, _ := NewIPNSResolver(client, "/ipns/k51key", &ResolverOptions{TTL: time.Hour, NegativeTTL: time.Hour})
+	if got := r.Resolve("app", "v1"); !reflect.DeepEqual(got, []string{"bafyimage1"}) {
+		t.Fatalf("expected bafyimage1; got %v", got)
+	}
+
+	// republished
+	node.names["k51key"] = "/ipfs/bafyroot2"
+	r.(*liveResolver).checked = time.Time{}
+	if got := r.Resolve("app", "v1"); !reflect.DeepEqual(got, []string{"bafyimage2"}) {
+		t.Fatalf("expected bafyimage2; got %v", got)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	node := newFakeNode()
+	defer node.Close()
+
+	_, srv, done := newTestRegistry(t, &Config{
+		IPFSHost:     node.host(),
+		CIDResolvers: []string{"/ipns/k51unknown"},
+	})
+	defer done()
+
+	resp, err := http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var st statusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Resolvers) != 1 || st.Resolvers[0].Source != "/ipns/k51unknown" || st.Resolvers[0].Error == "" {
+		t.Fatalf("expected the resolution error to be reported; got %+v", st.Resolvers)
+	}
+}
+
+func TestHTTPResolverIndex(t *testing.T) {
+	var requests, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests++
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(`[
+			{"repo": "app", "tag": "v1", "cid": "bafyv1", "digest": "sha256:aaa"},
+			{"repo": "app", "tag": "v2", "cid": "bafyv2"},
+			{"repo": "team/api", "tag": "latest", "cid": "bafyapi"}
+		]`))
+	}))
+	defer srv.Close()
+
+	r, err := NewHTTPResolver(srv.URL+"/index.json", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cids := r.Resolve("app", "v1"); !reflect.DeepEqual(cids, []string{"bafyv1"}) {
+		t.Fatalf("expected [bafyv1]; got %v", cids)
+	}
+	if cids := r.Resolve("app", "sha256:aaa"); !reflect.DeepEqual(cids, []string{"bafyv1"}) {
+		t.Fatalf("expected [bafyv1]; got %v", cids)
+	}
+	if cids := r.Resolve("app", "v3"); cids != nil {
+		t.Fatalf("expected nil; got %v", cids)
+	}
+	if tags := r.Resolve("app", ""); !reflect.DeepEqual(tags, []string{"v1", "v2"}) {
+		t.Fatalf("expected [v1 v2]; got %v", tags)
+	}
+	if repos := r.(RepoLister).Repos(); !reflect.DeepEqual(repos, []string{"app", "team/api"}) {
+		t.Fatalf("expected [app team/api]; got %v", repos)
+	}
+	if requests != 5 || notModified != 4 {
+		t.Fatalf("expected 5 requests revalidated with the ETag; got %d, %d not modified", requests, notModified)
+	}
+
+	// stale index is used while the server is down
+	srv.Close()
+	if cids := r.Resolve("app", "v2"); !reflect.DeepEqual(cids, []string{"bafyv2"}) {
+		t.Fatalf("expected [bafyv2]; got %v", cids)
+	}
+	if st := r.(interface{ Status() ResolverStatus }).Status(); st.Error == "" {
+		t.Fatal("expected the error to be reported")
+	}
+
+	r, _ = NewHTTPResolver(srv.URL+"/index.json", "")
+	if cids := r.Resolve("app", "v1"); cids != nil {
+		t.Fatalf("expected nil; got %v", cids)
+	}
+}
+
+func TestHTTPResolverPaths(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		switch req.URL.Path {
+		case "/refs/team/app/":
+			w.Write([]byte(`["v1"]`))
+		case "/refs/team/app/v1":
+			w.Write([]byte("bafyv1\n"))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+
+	r := NewResolver(nil, []string{srv.URL + "/refs/"}, nil)
+	if cids := r.Resolve("team/app", "v1"); !reflect.DeepEqual(cids, []string{"bafyv1"}) {
+		t.Fatalf("expected [bafyv1]; got %v", cids)
+	}
+	if cids := r.Resolve("team/app", "v1"); !reflect.DeepEqual(cids, []string{"bafyv1"}) {
+		t.Fatalf("expected [bafyv1]; got %v", cids)
+	}
+	if requests != 1 {
+		t.Fatalf("expected the response to be cached; got %d requests", requests)
+	}
+	if tags := r.Resolve("team/app", ""); !reflect.DeepEqual(tags, []string{"v1"}) {
+		t.Fatalf("expected [v1]; got %v", tags)
+	}
+	if cids := r.Resolve("team/app", "v2"); len(cids) != 0 {
+		t.Fatalf("expected no CID; got %v", cids)
+	}
+	if cids := r.Resolve("team/app", "v2"); len(cids) != 0 {
+		t.Fatalf("expected no CID; got %v", cids)
+	}
+	if requests != 3 {
+		t.Fatalf("expected the not found response to be cached; got %d requests", requests)
+	}
+}
+
+func TestHTTPResolverCacheSize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		http.NotFound(w, req)
+	}))
+	defer srv.Close()
+
+	r, _ := NewHTTPResolver(srv.URL, "")
+	for i := 0; i < httpCacheSize+10; i++ {
+		r.Resolve(fmt.Sprintf("app%d", i), "latest")
+	}
+	if n := len(r.(*httpResolver).cache); n != httpCacheSize {
+		t.Fatalf("expected %d cached responses; got %d", httpCacheSize, n)
+	}
+}
+
+func TestResolverPrecedence(t *testing.T) {
+	var dirs []string
+	for _, cid := range []string{"bafya", "bafyb"} {
+		dir, err := ioutil.TempDir("", "ipdr")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for _, ref := range []string{"team/app/prod", "web/" + cid} {
+			os.MkdirAll(filepath.Join(dir, filepath.Dir(ref)), os.ModePerm)
+			ioutil.WriteFile(filepath.Join(dir, ref), []byte(cid), 0644)
+		}
+		dirs = append(dirs, "file:"+dir)
+	}
+
+	r := NewResolver(nil, dirs, nil)
+	if cids := r.Resolve("team/app", "prod"); !reflect.DeepEqual(cids, []string{"bafya"}) {
+		t.Fatalf("expected [bafya]; got %v", cids)
+	}
+	ex := r.(*resolver).Explain("team/app", "prod")
+	if !ex.Conflict || ex.CID != "bafya" || !ex.Answers[0].Winner || ex.Answers[1].Winner {
+		t.Fatalf("expected a conflict won by the first resolver; got %+v", ex)
+	}
+	if cids := r.Resolve("web", "bafyb"); !reflect.DeepEqual(cids, []string{"bafyb"}) {
+		t.Fatalf("expected [bafyb]; got %v", cids)
+	}
+
+	r = NewResolver(nil, dirs, &ResolverOptions{Precedence: PrecedenceAgree})
+	if cids := r.Resolve("team/app", "prod"); cids != nil {
+		t.Fatalf("expected conflicting answers to be rejected; got %v", cids)
+	}
+	if cids := r.Resolve("web", "bafya"); !reflect.DeepEqual(cids, []string{"bafya"}) {
+		t.Fatalf("expected [bafya]; got %v", cids)
+	}
+
+	r = NewResolver(nil, dirs, &ResolverOptions{Authority: map[string]string{"team/*": dirs[1]}})
+	if cids := r.Resolve("team/app", "prod"); !reflect.DeepEqual(cids, []string{"bafyb"}) {
+		t.Fatalf("expected [bafyb]; got %v", cids)
+	}
+	if cids := r.Resolve("web", "bafya"); !reflect.DeepEqual(cids, []string{"bafya"}) {
+		t.Fatalf("expected [bafya]; got %v", cids)
+	}
+}
+
+func TestResolverInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewResolver(nil, []string{"http://%zz"}, &ResolverOptions{Log: log.New(&buf, "", 0)})
+	if n := len(r.(*resolver).resolvers); n != 0 {
+		t.Fatalf("expected no resolver; got %d", n)
+	}
+	if !strings.Contains(buf.String(), "http://%zz") {
+		t.Fatalf("expected the invalid resolver to be logged; got %q", buf.String())
+	}
+}
+
+func TestResolverFirstHit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipdr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "app"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(dir, "app", "v1"), []byte("bafya"), 0644)
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("bafyb"))
+	}))
+	defer srv.Close()
+
+	r := NewResolver(nil, []string{"file:" + dir, srv.URL}, nil)
+	if cids := r.Resolve("app", "v1"); !reflect.DeepEqual(cids, []string{"bafya"}) {
+		t.Fatalf("expected [bafya]; got %v", cids)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("expected the first answer to win without asking the next resolver; got %d requests", n)
+	}
+	if cids := r.Resolve("app", "v2"); !reflect.DeepEqual(cids, []string{"bafyb"}) {
+		t.Fatalf("expected [bafyb]; got %v", cids)
+	}
+	if ex := r.(*resolver).Explain("app", "v1"); !ex.Conflict {
+		t.Fatalf("expected explain to ask every resolver; got %+v", ex)
+	}
+}
@@ -0,0 +1,96 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// https://github.com/opencontainers/distribution-spec/blob/master/spec.md#pulling-manifests
+var tagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+func isTag(s string) bool {
+	return tagRegexp.MatchString(s)
+}
+
+// Returns whether this url should be handled by the tags handler
+func isTags(req *http.Request) bool {
+	elems := strings.Split(req.URL.Path, "/")
+	elems = elems[1:]
+	if len(elems) < 4 {
+		return false
+	}
+	return elems[len(elems)-2] == "tags" && elems[len(elems)-1] == "list"
+}
+
+type tagsResponse struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// https://github.com/opencontainers/distribution-spec/blob/master/spec.md#listing-tags
+func (r *registry) tags(resp http.ResponseWriter, req *http.Request) *regError {
+	elem := strings.Split(req.URL.Path, "/")
+	elem = elem[1:]
+	repo := strings.Join(elem[1:len(elem)-2], "/")
+
+	if req.Method != "GET" {
+		return &regError{
+			Status:  http.StatusBadRequest,
+			Code:    "METHOD_UNKNOWN",
+			Message: "We don't understand your method + url",
+		}
+	}
+
+	// local/cached, the tags inside CID repos and resolvers
+	list := r.cids.Tags(repo)
+	if cid, ok := cidRepo(repo); ok {
+		list = append(list, r.cidTags(cid)...)
+	}
+	list = append(list, r.resolver.Resolve(repo, "")...)
+
+	var tags []string
+	for _, t := range uniq(list) {
+		if isTag(t) {
+			tags = append(tags, t)
+		}
+	}
+	if len(tags) == 0 {
+		return &regError{
+			Status:  http.StatusNotFound,
+			Code:    "NAME_UNKNOWN",
+			Message: "repository name not known to registry",
+		}
+	}
+
+	page, link, rerr := paginate(tags, req)
+	if rerr != nil {
+		return rerr
+	}
+	if link != "" {
+		resp.Header().Set("Link", link)
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	json.NewEncoder(resp).Encode(tagsResponse{
+		Name: repo,
+		Tags: page,
+	})
+	return nil
+}
+
+// cidTags returns the names of the manifests in the image directory, its tags and digests
+func (r *registry) cidTags(cid string) []string {
+	links, err := r.ipfsClient.List(path.Join(cid, "manifests"))
+	if err != nil {
+		r.log.Printf("list tags of %s: %v", cid, err)
+		return nil
+	}
+	var list []string
+	for _, l := range links {
+		list = append(list, l.Name)
+	}
+	return list
+}
@@ -0,0 +1,161 @@
+package registry
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// https://docs.docker.com/registry/spec/auth/jwt/
+
+var (
+	// ErrInvalidToken is returned when a token is malformed or its signature doesn't match
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired is returned when a token is used outside of its validity period
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// tokenAccess is a resource scope, e.g. repository:foo/bar:pull,push
+type tokenAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// parseScope parses a scope of the form type:name:action[,action...]
+func parseScope(s string) (*tokenAccess, error) {
+	i := strings.Index(s, ":")
+	j := strings.LastIndex(s, ":")
+	if i <= 0 || j == i || j == len(s)-1 {
+		return nil, fmt.Errorf("invalid scope: %s", s)
+	}
+	return &tokenAccess{
+		Type:    s[:i],
+		Name:    s[i+1 : j],
+		Actions: strings.Split(s[j+1:], ","),
+	}, nil
+}
+
+func (a *tokenAccess) String() string {
+	return a.Type + ":" + a.Name + ":" + strings.Join(a.Actions, ",")
+}
+
+// tokenClaims is the claim set of the tokens issued by the registry
+type tokenClaims struct {
+	Issuer    string         `json:"iss"`
+	Subject   string         `json:"sub"`
+	Audience  string         `json:"aud"`
+	ExpiresAt int64          `json:"exp"`
+	NotBefore int64          `json:"nbf"`
+	IssuedAt  int64          `json:"iat"`
+	ID        string         `json:"jti"`
+	Access    []*tokenAccess `json:"access"`
+}
+
+// allows returns whether the claims grant every action of the scope
+func (c *tokenClaims) allows(scope *tokenAccess) bool {
+	for _, action := range scope.Actions {
+		var granted bool
+		for _, a := range c.Access {
+			if a.Type != scope.Type || a.Name != scope.Name {
+				continue
+			}
+			for _, ga := range a.Actions {
+				if ga == action || ga == "*" {
+					granted = true
+				}
+			}
+		}
+		if !granted {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenIssuer issues and verifies HS256 signed JWTs
+type tokenIssuer struct {
+	key     []byte
+	service string
+	ttl     time.Duration
+}
+
+func (t *tokenIssuer) issue(subject string, access []*tokenAccess) (string, *tokenClaims, error) {
+	id, err := newUUID()
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	claims := &tokenClaims{
+		Issuer:    t.service,
+		Subject:   subject,
+		Audience:  t.service,
+		ExpiresAt: now.Add(t.ttl).Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        id,
+		Access:    access,
+	}
+
+	header, err := json.Marshal(map[string]string{"typ": "JWT", "alg": "HS256"})
+	if err != nil {
+		return "", nil, err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	signed := encodeSegment(header) + "." + encodeSegment(payload)
+	return signed + "." + encodeSegment(t.sign(signed)), claims, nil
+}
+
+func (t *tokenIssuer) verify(token string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	sig, err := decodeSegment(parts[2])
+	if err != nil || !hmac.Equal(sig, t.sign(parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	b, err := decodeSegment(parts[0])
+	if err != nil || json.Unmarshal(b, &header) != nil || header.Alg != "HS256" {
+		return nil, ErrInvalidToken
+	}
+	var claims tokenClaims
+	b, err = decodeSegment(parts[1])
+	if err != nil || json.Unmarshal(b, &claims) != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Audience != t.service {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now().Unix()
+	if now >= claims.ExpiresAt || now < claims.NotBefore {
+		return nil, ErrTokenExpired
+	}
+	return &claims, nil
+}
+
+func (t *tokenIssuer) sign(s string) []byte {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
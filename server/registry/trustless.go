@@ -0,0 +1,295 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/ipfs/go-cid"
+	"github.com/miguelmota/ipdr/ipfs"
+)
+
+// https://github.com/ipfs/specs/blob/main/http-gateways/TRUSTLESS_GATEWAY.md
+const rawBlockType = "application/vnd.ipld.raw"
+
+// UnixFS node types
+// https://github.com/ipfs/specs/blob/main/UNIXFS.md
+const (
+	unixfsRaw       = 0
+	unixfsFile      = 2
+	unixfsHAMTShard = 5
+)
+
+// maxBlockSize bounds the blocks accepted from the gateway, blocks are at most 2MiB by convention
+const maxBlockSize = 4 << 20
+
+var errMalformedBlock = errors.New("malformed block")
+
+// trustlessGateway fetches content as raw blocks and verifies every block against its CID,
+// so the gateway doesn't need to be trusted.
+// Only the dag-pb UnixFS directories and files written by ipfs add are supported.
+type trustlessGateway struct {
+	gateways *ipfs.GatewaySet
+}
+
+type pbLink struct {
+	cid  cid.Cid
+	name string
+}
+
+// get returns the content of the file at root/s
+func (g *trustlessGateway) get(root string, s []string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := g.copy(&buf, root, s); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// copy writes the content of the file at root/s to w as its blocks are verified
+func (g *trustlessGateway) copy(w io.Writer, root string, s []string) error {
+	c, err := g.resolve(root, s)
+	if err != nil {
+		return err
+	}
+	return g.file(w, c)
+}
+
+// size returns the size of the file at root/s
+func (g *trustlessGateway) size(root string, s []string) (int64, error) {
+	c, err := g.resolve(root, s)
+	if err != nil {
+		return 0, err
+	}
+	if c.Type() == cid.Raw {
+		b, err := g.block(c)
+		return int64(len(b)), err
+	}
+	_, data, err := g.node(c)
+	if err != nil {
+		return 0, err
+	}
+	d, err := decodeUnixFS(data)
+	if err != nil {
+		return 0, err
+	}
+	return int64(d.filesize), nil
+}
+
+// resolve walks the path s from root, verifying every directory on the way
+func (g *trustlessGateway) resolve(root string, s []string) (cid.Cid, error) {
+	c, err := cid.Decode(root)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	for _, name := range s {
+		links, _, err := g.node(c)
+		if err != nil {
+			return cid.Cid{}, err
+		}
+		found := false
+		for _, l := range links {
+			if l.name == name {
+				c, found = l.cid, true
+				break
+			}
+		}
+		if !found {
+			return cid.Cid{}, fmt.Errorf("cid: %s no link named %q", c, name)
+		}
+	}
+	return c, nil
+}
+
+// file writes the content of the UnixFS file c to w
+func (g *trustlessGateway) file(w io.Writer, c cid.Cid) error {
+	if c.Type() == cid.Raw {
+		b, err := g.block(c)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+
+	links, data, err := g.node(c)
+	if err != nil {
+		return err
+	}
+	d, err := decodeUnixFS(data)
+	if err != nil {
+		return err
+	}
+	if d.typ != unixfsFile && d.typ != unixfsRaw {
+		return fmt.Errorf("cid: %s is not a file", c)
+	}
+	if _, err := w.Write(d.content); err != nil {
+		return err
+	}
+	for _, l := range links {
+		if err := g.file(w, l.cid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// node returns the links and data of the dag-pb node c
+func (g *trustlessGateway) node(c cid.Cid) ([]pbLink, []byte, error) {
+	if c.Type() != cid.DagProtobuf {
+		return nil, nil, fmt.Errorf("cid: %s unsupported codec %d", c, c.Type())
+	}
+	b, err := g.block(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	links, data, err := decodePBNode(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cid: %s %v", c, err)
+	}
+	if d, err := decodeUnixFS(data); err == nil && d.typ == unixfsHAMTShard {
+		return nil, nil, fmt.Errorf("cid: %s sharded directories are not supported", c)
+	}
+	return links, data, nil
+}
+
+// block fetches the raw block c and verifies its hash
+func (g *trustlessGateway) block(c cid.Cid) ([]byte, error) {
+	header := http.Header{}
+	header.Set("Accept", rawBlockType)
+	resp, err := g.gateways.Do("GET", c.String()+"?format=raw", header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cid: %s %s", c, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxBlockSize {
+		return nil, fmt.Errorf("cid: %s block too large", c)
+	}
+	sum, err := c.Prefix().Sum(b)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, fmt.Errorf("cid: %s block hash mismatch", c)
+	}
+	return b, nil
+}
+
+// decodePBNode decodes the links and data of a dag-pb node
+// https://ipld.io/specs/codecs/dag-pb/spec/
+func decodePBNode(b []byte) ([]pbLink, []byte, error) {
+	var links []pbLink
+	var data []byte
+	err := decodeProto(b, func(field int, v uint64, buf []byte) error {
+		switch field {
+		case 1:
+			data = buf
+		case 2:
+			var l pbLink
+			err := decodeProto(buf, func(field int, v uint64, buf []byte) error {
+				switch field {
+				case 1:
+					c, err := cid.Cast(buf)
+					if err != nil {
+						return err
+					}
+					l.cid = c
+				case 2:
+					l.name = string(buf)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if !l.cid.Defined() {
+				return errMalformedBlock
+			}
+			links = append(links, l)
+		}
+		return nil
+	})
+	return links, data, err
+}
+
+type unixfsData struct {
+	typ      int
+	content  []byte
+	filesize uint64
+}
+
+// decodeUnixFS decodes the type, content and file size of UnixFS data
+func decodeUnixFS(b []byte) (*unixfsData, error) {
+	d := &unixfsData{typ: -1}
+	err := decodeProto(b, func(field int, v uint64, buf []byte) error {
+		switch field {
+		case 1:
+			d.typ = int(v)
+		case 2:
+			d.content = buf
+		case 3:
+			d.filesize = v
+		}
+		return nil
+	})
+	if err == nil && d.typ < 0 {
+		err = errMalformedBlock
+	}
+	return d, err
+}
+
+// decodeProto calls fn with the number and the varint or bytes value of every field of a protobuf message
+func decodeProto(b []byte, fn func(field int, v uint64, buf []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errMalformedBlock
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		var v uint64
+		var buf []byte
+		switch key & 7 {
+		case 0: // varint
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errMalformedBlock
+			}
+			b = b[n:]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return errMalformedBlock
+			}
+			b = b[8:]
+		case 2: // length delimited
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errMalformedBlock
+			}
+			buf = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return errMalformedBlock
+			}
+			b = b[4:]
+		default:
+			return errMalformedBlock
+		}
+		if err := fn(field, v, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
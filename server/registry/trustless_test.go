@@ -0,0 +1,142 @@
+package registry
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// blockstore is a stand-in for a trustless gateway serving raw blocks
+type blockstore struct {
+	*httptest.Server
+	blocks map[string][]byte
+	lock   sync.Mutex
+}
+
+func newBlockstore() *blockstore {
+	bs := &blockstore{blocks: map[string][]byte{}}
+	bs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		bs.lock.Lock()
+		defer bs.lock.Unlock()
+		b, ok := bs.blocks[strings.TrimPrefix(req.URL.Path, "/ipfs/")]
+		if !ok || req.URL.Query().Get("format") != "raw" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", rawBlockType)
+		w.Write(b)
+	}))
+	return bs
+}
+
+func (bs *blockstore) put(codec uint64, b []byte) cid.Cid {
+	c, err := cid.Prefix{Version: 1, Codec: codec, MhType: multihash.SHA2_256, MhLength: -1}.Sum(b)
+	if err != nil {
+		panic(err)
+	}
+	bs.lock.Lock()
+	bs.blocks[c.String()] = b
+	bs.lock.Unlock()
+	return c
+}
+
+// file adds a UnixFS file made of a leaf per chunk
+func (bs *blockstore) file(chunks ...string) cid.Cid {
+	var links []pbLink
+	var size uint64
+	for _, c := range chunks {
+		links = append(links, pbLink{cid: bs.put(cid.Raw, []byte(c))})
+		size += uint64(len(c))
+	}
+	data := append(protoVarint(1, unixfsFile), protoVarint(3, size)...)
+	return bs.put(cid.DagProtobuf, pbNode(links, data))
+}
+
+func (bs *blockstore) dir(links ...pbLink) cid.Cid {
+	return bs.put(cid.DagProtobuf, pbNode(links, protoVarint(1, 1)))
+}
+
+func pbNode(links []pbLink, data []byte) []byte {
+	var b []byte
+	for _, l := range links {
+		link := append(protoBytes(1, l.cid.Bytes()), protoBytes(2, []byte(l.name))...)
+		b = append(b, protoBytes(2, link)...)
+	}
+	return append(b, protoBytes(1, data)...)
+}
+
+func protoVarint(field int, v uint64) []byte {
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(field)<<3)
+	n += binary.PutUvarint(buf[n:], v)
+	return buf[:n]
+}
+
+func protoBytes(field int, b []byte) []byte {
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(field)<<3|2)
+	n += binary.PutUvarint(buf[n:], uint64(len(b)))
+	return append(buf[:n], b...)
+}
+
+func TestTrustlessGateway(t *testing.T) {
+	bs := newBlockstore()
+	defer bs.Close()
+
+	mf := `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","layers":[]}`
+	layer := "layer content"
+	digest := computeDigest([]byte(layer))
+	root := bs.dir(
+		pbLink{name: "blobs", cid: bs.dir(pbLink{name: digest, cid: bs.file("layer ", "content")})},
+		pbLink{name: "manifests", cid: bs.dir(pbLink{name: "latest", cid: bs.file(mf[:10], mf[10:])})},
+	)
+
+	r, srv, done := newTestRegistry(t, &Config{IPFSGateway: bs.URL, TrustlessGateway: true})
+	defer done()
+	r.cids.Add("app", digest, root.String())
+
+	m, err := r.manifests.getManifest(root.String(), "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.blob) != mf {
+		t.Fatalf("expected %s; got %s", mf, m.blob)
+	}
+	if _, err := r.manifests.getManifest(root.String(), "v1"); err == nil {
+		t.Fatal("expected unknown manifest to fail")
+	}
+
+	resp, err := http.Get(srv.URL + "/v2/app/blobs/" + digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(b) != layer {
+		t.Fatalf("expected %s; got %s, %v", layer, b, err)
+	}
+	if resp.ContentLength != int64(len(layer)) {
+		t.Fatalf("expected content length %d; got %d", len(layer), resp.ContentLength)
+	}
+
+	// a gateway substituting a block is caught
+	leaf := bs.put(cid.Raw, []byte("content"))
+	bs.lock.Lock()
+	bs.blocks[leaf.String()] = []byte("c0ntent")
+	bs.lock.Unlock()
+	resp, err = http.Get(srv.URL + "/v2/app/blobs/" + digest)
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Fatal("expected the response to be aborted")
+	}
+}
@@ -0,0 +1,111 @@
+package registry
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upload is an in-flight blob upload session spooled to the scratch directory.
+// The sha256 is computed incrementally as chunks arrive so the layer never has to be held in memory.
+type upload struct {
+	// unix nano time of the last write, accessed atomically
+	touched int64
+
+	id   string
+	file *os.File
+	hash hash.Hash
+	size int64
+	// set once the upload is committed or aborted
+	done bool
+
+	sync.Mutex
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+func newUpload(dir, id string) (*upload, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "uploads"), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(dir, "uploads", id))
+	if err != nil {
+		return nil, err
+	}
+	return &upload{
+		touched: time.Now().UnixNano(),
+		id:      id,
+		file:    f,
+		hash:    sha256.New(),
+	}, nil
+}
+
+// write appends r to the upload and returns the number of bytes written.
+func (u *upload) write(r io.Reader) (int64, error) {
+	u.touch()
+	defer u.touch()
+	n, err := io.Copy(io.MultiWriter(u.file, u.hash), r)
+	u.size += n
+	return n, err
+}
+
+func (u *upload) touch() {
+	atomic.StoreInt64(&u.touched, time.Now().UnixNano())
+}
+
+// idle returns the time since the last write
+func (u *upload) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&u.touched)))
+}
+
+// rangeHeader returns the Range header value of the received content, e.g. 0-1023
+func (u *upload) rangeHeader() string {
+	if u.size == 0 {
+		return "0-0"
+	}
+	return fmt.Sprintf("0-%d", u.size-1)
+}
+
+func (u *upload) digest() string {
+	return "sha256:" + hex.EncodeToString(u.hash.Sum(nil))
+}
+
+// commit moves the finished upload into the blob directory and returns its path.
+func (u *upload) commit(dir, digest string) (string, error) {
+	u.done = true
+	if err := u.file.Close(); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), os.ModePerm); err != nil {
+		return "", err
+	}
+	p := filepath.Join(dir, "blobs", digest)
+	if err := os.Rename(u.file.Name(), p); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// abort discards the spooled data.
+func (u *upload) abort() {
+	u.done = true
+	u.file.Close()
+	os.Remove(u.file.Name())
+}
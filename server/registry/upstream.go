@@ -0,0 +1,411 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/miguelmota/ipdr/server/registry/image"
+)
+
+// upstream is the Distribution registry images are mirrored from when they can't be resolved.
+// Images are served from upstream while they are added to IPFS in the background.
+type upstream struct {
+	host    string
+	options []name.Option
+
+	// Upstream tags move, so the mirrored ones recorded in the CID store
+	// are checked against upstream once older than ttl.
+	// maps repo:tag -> mirrored tag
+	tags map[string]*mirroredTag
+	ttl  time.Duration
+
+	// mirrors in progress keyed by repo:reference
+	pending map[string]bool
+	lock    sync.Mutex
+
+	registry *registry
+}
+
+// mirroredTag is the digest an upstream tag pointed to when it was last checked, empty when upstream didn't know it
+type mirroredTag struct {
+	digest  string
+	checked time.Time
+}
+
+// newUpstream returns the upstream of the registry URL, e.g. https://registry.example
+// Plain http is used for http URLs.
+func newUpstream(r *registry, rawurl string, ttl time.Duration) *upstream {
+	u := &upstream{
+		host:     rawurl,
+		tags:     map[string]*mirroredTag{},
+		ttl:      ttl,
+		pending:  map[string]bool{},
+		registry: r,
+	}
+	if strings.Contains(rawurl, "://") {
+		if pu, err := url.Parse(rawurl); err == nil {
+			u.host = pu.Host
+			if pu.Scheme == "http" {
+				u.options = append(u.options, name.Insecure)
+			}
+		}
+	}
+	return u
+}
+
+func (u *upstream) reference(repo, target string) (name.Reference, error) {
+	if isDigest(target) {
+		return name.NewDigest(u.host+"/"+repo+"@"+target, u.options...)
+	}
+	return name.NewTag(u.host+"/"+repo+":"+target, u.options...)
+}
+
+func (u *upstream) remoteOptions() []remote.Option {
+	return []remote.Option{remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+}
+
+// manifest returns the manifest from IPFS when it's already mirrored, along with the CID holding it.
+// Otherwise it fetches the manifest from upstream and starts mirroring the image into IPFS.
+func (u *upstream) manifest(repo, target string) (*manifest, string, error) {
+	ref, err := u.reference(repo, target)
+	if err != nil {
+		return nil, "", err
+	}
+	digest := target
+	if !isDigest(target) {
+		digest = u.current(repo, target, ref)
+	}
+	if digest != "" {
+		if mf, cid, err := u.mirrored(digest); err == nil {
+			if !isDigest(target) {
+				u.registry.cids.Add(repo, target, cid)
+			}
+			return mf, cid, nil
+		}
+	}
+
+	desc, err := remote.Get(ref, u.remoteOptions()...)
+	if err != nil {
+		return nil, "", err
+	}
+	if !isDigest(target) {
+		u.tag(repo, target, desc.Digest.String())
+	}
+
+	go u.mirror(repo, target, desc)
+
+	return &manifest{
+		blob:        desc.Manifest,
+		contentType: string(desc.MediaType),
+		digest:      desc.Digest.String(),
+	}, "", nil
+}
+
+// current returns the digest the upstream tag points to, which is checked with a HEAD once older than the TTL.
+// The last known digest keeps being used while upstream can't be reached.
+func (u *upstream) current(repo, tag string, ref name.Reference) string {
+	u.lock.Lock()
+	t, ok := u.tags[key(repo, tag)]
+	u.lock.Unlock()
+	if ok && time.Since(t.checked) < u.ttl {
+		return t.digest
+	}
+
+	desc, err := remote.Head(ref, u.remoteOptions()...)
+	if err != nil {
+		if ok && t.digest != "" {
+			u.registry.log.Printf("check %s/%s:%s: %v", u.host, repo, tag, err)
+			return t.digest
+		}
+		// unknown upstream, e.g. pushed, checked again once the TTL expires
+		u.tag(repo, tag, "")
+		return ""
+	}
+	u.tag(repo, tag, desc.Digest.String())
+	return desc.Digest.String()
+}
+
+// moved returns whether the tag recorded in the CID store points to another image upstream now
+// than the one cid holds. Tags upstream doesn't know, e.g. pushed ones, never move,
+// and neither do mirrored ones while upstream can't be reached.
+func (u *upstream) moved(repo, tag, cid string) bool {
+	if isDigest(tag) {
+		return false
+	}
+	if _, ok := u.registry.cids.Get(repo, tag); !ok {
+		return false
+	}
+	ref, err := u.reference(repo, tag)
+	if err != nil {
+		return false
+	}
+	digest := u.current(repo, tag, ref)
+	if digest == "" {
+		return false
+	}
+	if info, ok := u.registry.index.Get(digest); ok {
+		for _, c := range info.CIDs {
+			if c == cid {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// tag records the digest the upstream tag points to
+func (u *upstream) tag(repo, tag, digest string) {
+	u.lock.Lock()
+	u.tags[key(repo, tag)] = &mirroredTag{digest: digest, checked: time.Now()}
+	u.lock.Unlock()
+}
+
+// mirrored reads the manifest from the CID it was mirrored to, which the blob index records
+func (u *upstream) mirrored(digest string) (*manifest, string, error) {
+	info, ok := u.registry.index.Get(digest)
+	if !ok || len(info.CIDs) == 0 {
+		return nil, "", fmt.Errorf("%s not mirrored", digest)
+	}
+	mf, err := u.registry.manifests.getManifest(info.CIDs[0], digest)
+	if err != nil {
+		return nil, "", err
+	}
+	return mf, info.CIDs[0], nil
+}
+
+// blob serves the blob straight from upstream
+func (u *upstream) blob(resp http.ResponseWriter, req *http.Request, repo, digest string) *regError {
+	ref, err := name.NewDigest(u.host+"/"+repo+"@"+digest, u.options...)
+	if err != nil {
+		return &regError{
+			Status:  http.StatusNotFound,
+			Code:    "BLOB_UNKNOWN",
+			Message: err.Error(),
+		}
+	}
+	layer, err := remote.Layer(ref, u.remoteOptions()...)
+	if err != nil {
+		return &regError{
+			Status:  http.StatusNotFound,
+			Code:    "BLOB_UNKNOWN",
+			Message: err.Error(),
+		}
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return &regError{
+			Status:  http.StatusNotFound,
+			Code:    "BLOB_UNKNOWN",
+			Message: err.Error(),
+		}
+	}
+
+	resp.Header().Set("Content-Length", fmt.Sprint(size))
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.Header().Set("Docker-Content-Digest", digest)
+	if req.Method == "HEAD" {
+		resp.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return &regError{
+			Status:  http.StatusNotFound,
+			Code:    "BLOB_UNKNOWN",
+			Message: err.Error(),
+		}
+	}
+	defer rc.Close()
+	resp.WriteHeader(http.StatusOK)
+	if err := u.registry.copyCached(resp, rc, digest); err != nil {
+		u.registry.log.Printf("GET %s from %s/%s: %v", digest, u.host, repo, err)
+		// the headers are sent, abort the response so the client doesn't take it as complete
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// mirror adds the image to IPFS unless it's already being mirrored
+func (u *upstream) mirror(repo, target string, desc *remote.Descriptor) {
+	key := repo + ":" + target
+	u.lock.Lock()
+	if u.pending[key] {
+		u.lock.Unlock()
+		return
+	}
+	u.pending[key] = true
+	u.lock.Unlock()
+
+	defer func() {
+		u.lock.Lock()
+		delete(u.pending, key)
+		u.lock.Unlock()
+	}()
+
+	cid, err := u.add(repo, target, desc)
+	if err != nil {
+		u.registry.log.Printf("mirror %s/%s: %v", u.host, key, err)
+		return
+	}
+	u.registry.log.Printf("mirrored %s/%s to %s", u.host, key, cid)
+}
+
+// add downloads the image, or every image of an index, and adds it to IPFS
+func (u *upstream) add(repo, target string, desc *remote.Descriptor) (string, error) {
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(u.registry.blobs.dir, "upstream", id)
+	defer os.RemoveAll(dir)
+
+	digest := desc.Digest.String()
+	refs := make(map[string][]byte)
+	refs[target] = desc.Manifest
+	refs[digest] = desc.Manifest
+	refs["latest"] = desc.Manifest // <cid>/latest
+
+	var images []v1.Image
+	var children []string
+	if image.IsIndex(string(desc.MediaType)) {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return "", err
+		}
+		im, err := idx.IndexManifest()
+		if err != nil {
+			return "", err
+		}
+		for _, d := range im.Manifests {
+			img, err := idx.Image(d.Digest)
+			if err != nil {
+				return "", err
+			}
+			raw, err := img.RawManifest()
+			if err != nil {
+				return "", err
+			}
+			refs[d.Digest.String()] = raw
+			children = append(children, d.Digest.String())
+			images = append(images, img)
+		}
+	} else {
+		img, err := desc.Image()
+		if err != nil {
+			return "", err
+		}
+		images = append(images, img)
+	}
+
+	layers := make(map[string]string)
+	for _, img := range images {
+		if err := u.fetchBlobs(dir, img, layers); err != nil {
+			return "", err
+		}
+	}
+
+	cid, err := u.registry.ipfsClient.AddImage(refs, layers)
+	if err != nil {
+		return "", err
+	}
+
+	// recorded like a push, the tag is revalidated against upstream on top of it
+	if !isDigest(target) {
+		u.tag(repo, target, digest)
+	}
+	u.registry.cids.Add(repo, target, cid)
+	u.registry.cids.Add(repo, digest, cid)
+	for _, d := range children {
+		u.registry.cids.Add(repo, d, cid)
+	}
+	for d := range layers {
+		u.registry.cids.Add(repo, d, cid)
+	}
+	for ref, b := range refs {
+		if isDigest(ref) {
+			u.registry.indexManifest(cid, b)
+		}
+	}
+	return cid, nil
+}
+
+// fetchBlobs downloads the config and layers of the image to dir
+func (u *upstream) fetchBlobs(dir string, img v1.Image, layers map[string]string) error {
+	config, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	if _, ok := layers[config.String()]; !ok {
+		raw, err := img.RawConfigFile()
+		if err != nil {
+			return err
+		}
+		if layers[config.String()], err = u.spool(dir, config.String(), ioutil.NopCloser(bytes.NewReader(raw))); err != nil {
+			return err
+		}
+	}
+
+	ls, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, l := range ls {
+		d, err := l.Digest()
+		if err != nil {
+			return err
+		}
+		if _, ok := layers[d.String()]; ok {
+			continue
+		}
+		rc, err := l.Compressed()
+		if err != nil {
+			return err
+		}
+		if layers[d.String()], err = u.spool(dir, d.String(), rc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spool writes the blob to dir, verifies its digest and records its size
+func (u *upstream) spool(dir, digest string, rc io.ReadCloser) (string, error) {
+	defer rc.Close()
+
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	up, err := newUpload(dir, id)
+	if err != nil {
+		return "", err
+	}
+	if _, err := up.write(rc); err != nil {
+		up.abort()
+		return "", err
+	}
+	if d := up.digest(); d != digest {
+		up.abort()
+		return "", fmt.Errorf("digest mismatch: %s != %s", d, digest)
+	}
+	p, err := up.commit(dir, digest)
+	if err != nil {
+		return "", err
+	}
+	u.registry.index.Add(digest, &blobInfo{Size: up.size})
+	return p, nil
+}
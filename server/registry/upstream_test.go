@@ -0,0 +1,220 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcr "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestUpstreamMirror(t *testing.T) {
+	up := httptest.NewServer(ggcr.New(ggcr.Logger(log.New(ioutil.Discard, "", 0))))
+	defer up.Close()
+
+	img, err := random.Image(64, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.NewTag(strings.TrimPrefix(up.URL, "http://") + "/library/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := img.Digest()
+	layers, _ := img.Layers()
+	layer, _ := layers[0].Digest()
+
+	node := newFakeNode()
+	defer node.Close()
+	r, srv, done := newTestRegistry(t, &Config{IPFSHost: node.host(), Upstream: up.URL})
+	defer done()
+
+	resp, err := http.Get(srv.URL + "/v2/library/app/manifests/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d; got %d", http.StatusOK, resp.StatusCode)
+	}
+	if d := resp.Header.Get("Docker-Content-Digest"); d != digest.String() {
+		t.Fatalf("expected digest %s; got %s", digest, d)
+	}
+
+	// served from upstream or IPFS depending on the progress of the mirror
+	resp, err = http.Head(srv.URL + "/v2/library/app/blobs/" + layer.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d; got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var cid string
+	for i := 0; i < 100 && cid == ""; i++ {
+		time.Sleep(20 * time.Millisecond)
+		cid, _ = r.cids.Get("library/app", digest.String())
+	}
+	if cid == "" {
+		t.Fatal("expected library/app:v1 to be mirrored into IPFS")
+	}
+	var tagged string
+	for i := 0; i < 100 && tagged != cid; i++ {
+		tagged, _ = r.cids.Get("library/app", "v1")
+		time.Sleep(20 * time.Millisecond)
+	}
+	if tagged != cid {
+		t.Fatalf("expected the mirrored tag to be recorded as %s; got %q", cid, tagged)
+	}
+	node.lock.Lock()
+	_, ok := node.files[cid+"/blobs/"+layer.String()]
+	node.lock.Unlock()
+	if !ok {
+		t.Fatalf("expected layer %s to be added; got %v", layer, node.paths(cid))
+	}
+
+	// served from IPFS after a restart while upstream is down
+	up.Close()
+	restarted := newRegistry(r.config, Logger(log.New(ioutil.Discard, "", log.LstdFlags)))
+	defer restarted.Close()
+	srv2 := httptest.NewServer(http.HandlerFunc(restarted.root))
+	defer srv2.Close()
+
+	resp, err = http.Get(srv2.URL + "/v2/library/app/manifests/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Docker-Content-ID") != cid {
+		t.Fatalf("expected %d from %s; got %d %q", http.StatusOK, cid, resp.StatusCode, resp.Header.Get("X-Docker-Content-ID"))
+	}
+	resp, err = http.Get(srv2.URL + "/v2/library/app/tags/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tr tagsResponse
+	json.NewDecoder(resp.Body).Decode(&tr)
+	resp.Body.Close()
+	if !reflect.DeepEqual(tr.Tags, []string{"v1"}) {
+		t.Fatalf("expected [v1]; got %v", tr.Tags)
+	}
+}
+
+func TestUpstreamTagMoved(t *testing.T) {
+	up := httptest.NewServer(ggcr.New(ggcr.Logger(log.New(ioutil.Discard, "", 0))))
+	defer up.Close()
+	ref, err := name.NewTag(strings.TrimPrefix(up.URL, "http://") + "/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func() string {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+		d, _ := img.Digest()
+		return d.String()
+	}
+
+	node := newFakeNode()
+	defer node.Close()
+	r, srv, done := newTestRegistry(t, &Config{IPFSHost: node.host(), Upstream: up.URL, UpstreamTTL: time.Nanosecond})
+	defer done()
+
+	get := func() *http.Response {
+		resp, err := http.Get(srv.URL + "/v2/app/manifests/latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	first := write()
+	if d := get().Header.Get("Docker-Content-Digest"); d != first {
+		t.Fatalf("expected %s; got %s", first, d)
+	}
+	for i := 0; i < 100; i++ {
+		if info, ok := r.index.Get(first); ok && len(info.CIDs) > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// mirrored, served from IPFS once upstream confirms the tag
+	if resp := get(); resp.Header.Get("Docker-Content-Digest") != first || resp.Header.Get("X-Docker-Content-ID") == "" {
+		t.Fatalf("expected %s from IPFS; got %s %q", first, resp.Header.Get("Docker-Content-Digest"), resp.Header.Get("X-Docker-Content-ID"))
+	}
+
+	second := write()
+	if d := get().Header.Get("Docker-Content-Digest"); d != second {
+		t.Fatalf("expected the moved tag %s; got %s", second, d)
+	}
+}
+
+func TestUpstreamBlob(t *testing.T) {
+	up := httptest.NewServer(ggcr.New(ggcr.Logger(log.New(ioutil.Discard, "", 0))))
+	defer up.Close()
+
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, _ := name.NewTag(strings.TrimPrefix(up.URL, "http://") + "/app:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	layers, _ := img.Layers()
+	layer, _ := layers[0].Digest()
+	rc, _ := layers[0].Compressed()
+	content, _ := ioutil.ReadAll(rc)
+
+	dir, err := ioutil.TempDir("", "ipdr-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, srv, done := newTestRegistry(t, &Config{Upstream: up.URL, CacheDir: dir})
+	defer done()
+
+	resp, err := http.Get(srv.URL + "/v2/app/blobs/" + layer.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d; got %d", http.StatusOK, resp.StatusCode)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != string(content) {
+		t.Fatal("expected the upstream layer content")
+	}
+	if b, ok := r.cache.get(layer.String()); !ok || string(b) != string(content) {
+		t.Fatal("expected the upstream layer to be cached")
+	}
+
+	resp, err = http.Get(srv.URL + "/v2/app/blobs/" + computeDigest([]byte("nope")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d; got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
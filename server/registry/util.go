@@ -1,17 +1,22 @@
 package registry
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
 
-	"github.com/miguelmota/ipdr/netutil"
-	"github.com/miguelmota/ipdr/regutil"
+	"github.com/miguelmota/ipdr/ipfs"
 )
 
-func getContent(gw string, cid string, s []string) ([]byte, error) {
-	uri := regutil.IpfsURL(gw, append([]string{cid}, s...))
-	resp, err := netutil.Get(uri)
+func getContent(gateways *ipfs.GatewaySet, cid string, s []string) ([]byte, error) {
+	resp, err := gateways.Do("GET", path.Join(append([]string{cid}, s...)...), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -21,3 +26,78 @@ func getContent(gw string, cid string, s []string) ([]byte, error) {
 	}
 	return ioutil.ReadAll(resp.Body)
 }
+
+// copyVerified copies r to w and checks the sha256 digest of the content.
+// The last chunk is held back until the digest is verified so that w never
+// receives the complete content when it doesn't match.
+func copyVerified(w io.Writer, r io.Reader, digest string) (int64, error) {
+	h := sha256.New()
+	buf := make([]byte, 32*1024)
+	var held []byte
+	var written int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if len(held) > 0 {
+				if _, err := w.Write(held); err != nil {
+					return written, err
+				}
+				written += int64(len(held))
+			}
+			held = append(held[:0], buf[:n]...)
+			h.Write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	if d := "sha256:" + hex.EncodeToString(h.Sum(nil)); d != digest {
+		return written, fmt.Errorf("digest mismatch: %s != %s", d, digest)
+	}
+	n, err := w.Write(held)
+	return written + int64(n), err
+}
+
+// paginate applies the n and last query parameters to the list, which is sorted in place.
+// It returns the page and the Link header value pointing to the next page, if any.
+// https://github.com/opencontainers/distribution-spec/blob/master/spec.md#listing-tags
+func paginate(list []string, req *http.Request) ([]string, string, *regError) {
+	sort.Strings(list)
+
+	query := req.URL.Query()
+	if last := query.Get("last"); last != "" {
+		i := sort.SearchStrings(list, last)
+		if i < len(list) && list[i] == last {
+			i++
+		}
+		list = list[i:]
+	}
+
+	if query.Get("n") == "" {
+		return list, "", nil
+	}
+	n, err := strconv.Atoi(query.Get("n"))
+	if err != nil || n < 0 {
+		return nil, "", &regError{
+			Status:  http.StatusBadRequest,
+			Code:    "PAGINATION_NUMBER_INVALID",
+			Message: "invalid number of results requested",
+		}
+	}
+	if n >= len(list) {
+		return list, "", nil
+	}
+
+	list = list[:n]
+	if n == 0 {
+		return list, "", nil
+	}
+	next := url.Values{}
+	next.Set("n", strconv.Itoa(n))
+	next.Set("last", list[n-1])
+	link := fmt.Sprintf(`<%s?%s>; rel="next"`, req.URL.Path, next.Encode())
+	return list, link, nil
+}
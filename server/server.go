@@ -2,8 +2,11 @@ package server
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"time"
 
 	ipfs "github.com/miguelmota/ipdr/ipfs"
 	"github.com/miguelmota/ipdr/server/registry"
@@ -12,27 +15,74 @@ import (
 
 // Server is server structure
 type Server struct {
-	debug        bool
-	listener     net.Listener
-	host         string
-	ipfsHost     string
-	ipfsGateway  string
-	cidResolvers []string
-	cidStorePath string
-	tlsCertPath  string
-	tlsKeyPath   string
+	debug         bool
+	listener      net.Listener
+	handler       http.Handler
+	host          string
+	ipfsHost      string
+	ipfsGateway   string
+	gwTimeout     time.Duration
+	gwRace        int
+	cidResolvers  []string
+	cidStorePath  string
+	resolverTTL   time.Duration
+	negativeTTL   time.Duration
+	resolverToken string
+	precedence    string
+	authority     map[string]string
+	blobIndexPath string
+	uploadDir     string
+	uploadTTL     time.Duration
+	disableDelete bool
+	unpinOnDelete bool
+	authHtpasswd  string
+	authKeyPath   string
+	authRealm     string
+	authService   string
+	authPolicy    string
+	upstream      string
+	upstreamTTL   time.Duration
+	trustless     bool
+	contentSource string
+	cacheDir      string
+	cacheSize     int64
+	tlsCertPath   string
+	tlsKeyPath    string
 }
 
 // Config is server config
 type Config struct {
-	Debug        bool
-	Port         uint
-	IPFSHost     string
-	IPFSGateway  string
-	CIDResolvers []string
-	CIDStorePath string
-	TLSCertPath  string
-	TLSKeyPath   string
+	Debug               bool
+	Port                uint
+	IPFSHost            string
+	IPFSGateway         string
+	GatewayTimeout      time.Duration
+	GatewayRace         int
+	CIDResolvers        []string
+	CIDStorePath        string
+	ResolverTTL         time.Duration
+	ResolverNegativeTTL time.Duration
+	ResolverToken       string
+	ResolverPrecedence  string
+	ResolverAuthority   map[string]string
+	BlobIndexPath       string
+	UploadDir           string
+	UploadTTL           time.Duration
+	DisableDelete       bool
+	UnpinOnDelete       bool
+	AuthHtpasswd        string
+	AuthKeyPath         string
+	AuthRealm           string
+	AuthService         string
+	AuthPolicy          string
+	Upstream            string
+	UpstreamTTL         time.Duration
+	TrustlessGateway    bool
+	ContentSource       string
+	CacheDir            string
+	CacheSize           int64
+	TLSCertPath         string
+	TLSKeyPath          string
 }
 
 // InfoResponse is response for manifest info response
@@ -58,14 +108,37 @@ func NewServer(config *Config) *Server {
 	}
 
 	return &Server{
-		host:         fmt.Sprintf("0.0.0.0:%v", port),
-		debug:        config.Debug,
-		ipfsHost:     config.IPFSHost,
-		ipfsGateway:  ipfs.NormalizeGatewayURL(config.IPFSGateway),
-		cidResolvers: config.CIDResolvers,
-		cidStorePath: config.CIDStorePath,
-		tlsCertPath:  config.TLSCertPath,
-		tlsKeyPath:   config.TLSKeyPath,
+		host:          fmt.Sprintf("0.0.0.0:%v", port),
+		debug:         config.Debug,
+		ipfsHost:      config.IPFSHost,
+		ipfsGateway:   ipfs.NormalizeGatewayURL(config.IPFSGateway),
+		gwTimeout:     config.GatewayTimeout,
+		gwRace:        config.GatewayRace,
+		cidResolvers:  config.CIDResolvers,
+		cidStorePath:  config.CIDStorePath,
+		resolverTTL:   config.ResolverTTL,
+		negativeTTL:   config.ResolverNegativeTTL,
+		resolverToken: config.ResolverToken,
+		precedence:    config.ResolverPrecedence,
+		authority:     config.ResolverAuthority,
+		blobIndexPath: config.BlobIndexPath,
+		uploadDir:     config.UploadDir,
+		uploadTTL:     config.UploadTTL,
+		disableDelete: config.DisableDelete,
+		unpinOnDelete: config.UnpinOnDelete,
+		authHtpasswd:  config.AuthHtpasswd,
+		authKeyPath:   config.AuthKeyPath,
+		authRealm:     config.AuthRealm,
+		authService:   config.AuthService,
+		authPolicy:    config.AuthPolicy,
+		upstream:      config.Upstream,
+		upstreamTTL:   config.UpstreamTTL,
+		trustless:     config.TrustlessGateway,
+		contentSource: config.ContentSource,
+		cacheDir:      config.CacheDir,
+		cacheSize:     config.CacheSize,
+		tlsCertPath:   config.TLSCertPath,
+		tlsKeyPath:    config.TLSKeyPath,
 	}
 }
 
@@ -80,12 +153,45 @@ func (s *Server) Start() error {
 		fmt.Fprintln(w, "OK")
 	})
 
-	http.Handle("/", registry.New(&registry.Config{
-		IPFSHost:     s.ipfsHost,
-		IPFSGateway:  s.ipfsGateway,
-		CIDResolvers: s.cidResolvers,
-		CIDStorePath: s.cidStorePath,
-	}))
+	var authKey []byte
+	if s.authKeyPath != "" {
+		var err error
+		authKey, err = ioutil.ReadFile(s.authKeyPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.handler = registry.New(&registry.Config{
+		IPFSHost:            s.ipfsHost,
+		IPFSGateway:         s.ipfsGateway,
+		GatewayTimeout:      s.gwTimeout,
+		GatewayRace:         s.gwRace,
+		CIDResolvers:        s.cidResolvers,
+		CIDStorePath:        s.cidStorePath,
+		ResolverTTL:         s.resolverTTL,
+		ResolverNegativeTTL: s.negativeTTL,
+		ResolverToken:       s.resolverToken,
+		ResolverPrecedence:  s.precedence,
+		ResolverAuthority:   s.authority,
+		BlobIndexPath:       s.blobIndexPath,
+		UploadDir:           s.uploadDir,
+		UploadTTL:           s.uploadTTL,
+		DisableDelete:       s.disableDelete,
+		UnpinOnDelete:       s.unpinOnDelete,
+		AuthHtpasswd:        s.authHtpasswd,
+		AuthKey:             authKey,
+		AuthRealm:           s.authRealm,
+		AuthService:         s.authService,
+		AuthPolicy:          s.authPolicy,
+		Upstream:            s.upstream,
+		UpstreamTTL:         s.upstreamTTL,
+		TrustlessGateway:    s.trustless,
+		ContentSource:       s.contentSource,
+		CacheDir:            s.cacheDir,
+		CacheSize:           s.cacheSize,
+	})
+	http.Handle("/", s.handler)
 
 	var err error
 	s.listener, err = net.Listen("tcp", s.host)
@@ -106,6 +212,9 @@ func (s *Server) Stop() {
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	if c, ok := s.handler.(io.Closer); ok {
+		c.Close()
+	}
 }
 
 // Debugf prints debug log